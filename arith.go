@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// arithNumber is the type arithmetic is carried out in: int64 normally, or
+// float64 for floating-point math.
+type arithNumber interface {
+	int64 | float64
+}
+
+// evalArithmetic evaluates an integer expression as used in $((...)). It
+// supports + - * / % ** with the usual precedence, unary signs, parentheses
+// and variable references, with or without a leading $. Unset or
+// non-numeric variables count as 0.
+func evalArithmetic(expr string) (int64, error) {
+	return evalExpression[int64](expr)
+}
+
+// evalFloat evaluates an expression like evalArithmetic but in floating
+// point, also accepting decimals and scientific notation such as 1.5e3.
+func evalFloat(expr string) (float64, error) {
+	return evalExpression[float64](expr)
+}
+
+func evalExpression[T arithNumber](expr string) (T, error) {
+	p := &arithParser[T]{input: expr}
+	p.next()
+	value, err := p.parseExpr()
+	if err != nil {
+		return 0, err
+	}
+	if p.token != "" {
+		return 0, fmt.Errorf("syntax error: unexpected '%s'", p.token)
+	}
+	return value, nil
+}
+
+// formatFloat prints a result without trailing zeros, switching to
+// scientific notation for very large or very small magnitudes.
+func formatFloat(value float64) string {
+	if abs := math.Abs(value); abs >= 1e21 || abs != 0 && abs < 1e-6 {
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// arithParser is a recursive descent parser that evaluates as it goes.
+type arithParser[T arithNumber] struct {
+	input string
+	pos   int
+	token string
+}
+
+// next advances to the following token, leaving "" at the end of input.
+func (p *arithParser[T]) next() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+	if p.pos >= len(p.input) {
+		p.token = ""
+		return
+	}
+	start := p.pos
+	c := rune(p.input[p.pos])
+	switch {
+	case unicode.IsDigit(c) || c == '.':
+		for p.pos < len(p.input) && isNumberChar(p.input, p.pos) {
+			p.pos++
+		}
+	case c == '$' || c == '_' || unicode.IsLetter(c):
+		p.pos++
+		for p.pos < len(p.input) && isNameChar(rune(p.input[p.pos])) {
+			p.pos++
+		}
+	case strings.HasPrefix(p.input[p.pos:], "**"):
+		p.pos += 2
+	default:
+		p.pos++
+	}
+	p.token = p.input[start:p.pos]
+}
+
+// isNumberChar reports whether input[i] continues a number, allowing for
+// decimals and exponents such as 2.5e-3.
+func isNumberChar(input string, i int) bool {
+	c := input[i]
+	switch {
+	case c >= '0' && c <= '9', c == '.', c == 'e', c == 'E':
+		return true
+	case c == '+' || c == '-':
+		return i > 0 && (input[i-1] == 'e' || input[i-1] == 'E')
+	}
+	return false
+}
+
+func isNameChar(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+func (p *arithParser[T]) parseExpr() (T, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return 0, err
+	}
+	for p.token == "+" || p.token == "-" {
+		op := p.token
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return 0, err
+		}
+		if op == "+" {
+			left += right
+		} else {
+			left -= right
+		}
+	}
+	return left, nil
+}
+
+func (p *arithParser[T]) parseTerm() (T, error) {
+	left, err := p.parsePower()
+	if err != nil {
+		return 0, err
+	}
+	for p.token == "*" || p.token == "/" || p.token == "%" {
+		op := p.token
+		p.next()
+		right, err := p.parsePower()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "*":
+			left *= right
+		case "/":
+			if right == 0 {
+				return 0, errors.New("division by zero")
+			}
+			left /= right
+		case "%":
+			if right == 0 {
+				return 0, errors.New("division by zero")
+			}
+			left = remainder(left, right)
+		}
+	}
+	return left, nil
+}
+
+// parsePower handles **, which is right associative.
+func (p *arithParser[T]) parsePower() (T, error) {
+	base, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	if p.token != "**" {
+		return base, nil
+	}
+	p.next()
+	exponent, err := p.parsePower()
+	if err != nil {
+		return 0, err
+	}
+	return power(base, exponent)
+}
+
+func remainder[T arithNumber](a, b T) T {
+	switch a := any(a).(type) {
+	case float64:
+		return T(math.Mod(a, float64(b)))
+	case int64:
+		return T(a % int64(b))
+	}
+	return 0
+}
+
+func power[T arithNumber](base, exponent T) (T, error) {
+	if f, ok := any(base).(float64); ok {
+		return T(math.Pow(f, float64(exponent))), nil
+	}
+	if exponent < 0 {
+		return 0, errors.New("exponent less than 0")
+	}
+	// Square and multiply, so huge exponents take a few dozen steps.
+	// Overflow wraps around, as in bash.
+	result := T(1)
+	for e := int64(exponent); e > 0; e >>= 1 {
+		if e&1 == 1 {
+			result *= base
+		}
+		base *= base
+	}
+	return result, nil
+}
+
+// parseNumber parses a literal or variable value as T.
+func parseNumber[T arithNumber](text string) (T, error) {
+	var zero T
+	if _, ok := any(zero).(float64); ok {
+		value, err := strconv.ParseFloat(text, 64)
+		return T(value), err
+	}
+	value, err := strconv.ParseInt(text, 10, 64)
+	return T(value), err
+}
+
+func (p *arithParser[T]) parseUnary() (T, error) {
+	switch p.token {
+	case "-":
+		p.next()
+		value, err := p.parseUnary()
+		return -value, err
+	case "+":
+		p.next()
+		return p.parseUnary()
+	}
+	return p.parsePrimary()
+}
+
+func (p *arithParser[T]) parsePrimary() (T, error) {
+	token := p.token
+	switch {
+	case token == "":
+		return 0, errors.New("syntax error: operand expected")
+	case token == "(":
+		p.next()
+		value, err := p.parseExpr()
+		if err != nil {
+			return 0, err
+		}
+		if p.token != ")" {
+			return 0, errors.New("syntax error: missing ')'")
+		}
+		p.next()
+		return value, nil
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		p.next()
+		value, err := parseNumber[T](token)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number '%s'", token)
+		}
+		return value, nil
+	case token[0] == '$' || isNameChar(rune(token[0])):
+		p.next()
+		name := strings.TrimPrefix(token, "$")
+		if name == "" {
+			return 0, errors.New("syntax error: missing variable name after '$'")
+		}
+		value, err := parseNumber[T](strings.TrimSpace(expandVariable(name)))
+		if err != nil {
+			return 0, nil
+		}
+		return value, nil
+	}
+	return 0, fmt.Errorf("syntax error: unexpected '%s'", token)
+}
+
+// expandArithmetic replaces every $((expr)) in line outside single quotes
+// with its value.
+func expandArithmetic(line string) (string, error) {
+	for {
+		start := indexUnquoted(line, "$((")
+		if start == -1 {
+			return line, nil
+		}
+		// Find the matching "))", allowing nested parentheses inside
+		depth := 0
+		end := -1
+		for i := start + 3; i < len(line) && end == -1; i++ {
+			switch line[i] {
+			case '(':
+				depth++
+			case ')':
+				if depth > 0 {
+					depth--
+				} else if i+1 < len(line) && line[i+1] == ')' {
+					end = i
+				}
+			}
+		}
+		if end == -1 {
+			return line, errors.New("syntax error: missing '))'")
+		}
+		var result string
+		if shellMathFloat {
+			value, err := evalFloat(line[start+3 : end])
+			if err != nil {
+				return line, err
+			}
+			result = formatFloat(value)
+		} else {
+			value, err := evalArithmetic(line[start+3 : end])
+			if err != nil {
+				return line, err
+			}
+			result = strconv.FormatInt(value, 10)
+		}
+		line = line[:start] + result + line[end+2:]
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestEvalArithmeticPower(t *testing.T) {
+	tests := []struct {
+		expr string
+		want int64
+	}{
+		{"2**10", 1024},
+		{"3**0", 1},
+		{"(-2)**3", -8},
+		{"2**3**2", 512},
+		{"2**62", 1 << 62},
+		// Overflow wraps around like bash, and a huge exponent is quick
+		{"2**64", 0},
+		{"3**9999999999", -2661479581325256021},
+		{"2**9999999999", 0},
+	}
+	for _, test := range tests {
+		got, err := evalArithmetic(test.expr)
+		if err != nil {
+			t.Errorf("evalArithmetic(%q): %v", test.expr, err)
+		} else if got != test.want {
+			t.Errorf("evalArithmetic(%q) = %d, want %d", test.expr, got, test.want)
+		}
+	}
+	if _, err := evalArithmetic("2**-1"); err == nil {
+		t.Error("evalArithmetic(2**-1) succeeded, want an error")
+	}
+}
@@ -0,0 +1,39 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// defaultSearchPath is searched for commands when PATH is empty.
+func defaultSearchPath() []string {
+	return []string{"/usr/local/bin", "/usr/bin", "/bin"}
+}
+
+// chownSupported reports whether the chown builtin works here. Files can change owner with os.Chown.
+const chownSupported = true
+
+// symlinkError returns the error from creating a symbolic link unchanged;
+// only Windows needs an explanation.
+func symlinkError(err error) error {
+	return err
+}
+
+// fileOwner returns the owner, group, inode and link count recorded for a
+// file, as far as the platform reports them.
+func fileOwner(info os.FileInfo) (uid, gid, inode, links uint64, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, 0, false
+	}
+	return uint64(stat.Uid), uint64(stat.Gid), uint64(stat.Ino), uint64(stat.Nlink), true
+}
+
+// systemShell returns the command line that runs line with the system
+// shell.
+func systemShell(line string) (string, []string) {
+	return "/bin/sh", []string{"-c", line}
+}
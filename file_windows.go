@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// defaultSearchPath is searched for commands when PATH is empty.
+func defaultSearchPath() []string {
+	root := os.Getenv("SystemRoot")
+	if root == "" {
+		root = `C:\Windows`
+	}
+	return []string{filepath.Join(root, "System32"), root, filepath.Join(root, "System32", "Wbem")}
+}
+
+// errorPrivilegeNotHeld is ERROR_PRIVILEGE_NOT_HELD, returned when creating a
+// symbolic link without the SeCreateSymbolicLinkPrivilege privilege.
+const errorPrivilegeNotHeld = syscall.Errno(1314)
+
+// chownSupported reports whether the chown builtin works here. Windows files have no Unix owner for chown to change.
+const chownSupported = false
+
+// symlinkError explains the error Windows returns when the user may not
+// create symbolic links.
+func symlinkError(err error) error {
+	if errors.Is(err, errorPrivilegeNotHeld) {
+		return errors.New("symbolic links require Administrator rights or Developer Mode")
+	}
+	return err
+}
+
+// fileOwner reports nothing on Windows, whose files have no Unix owner or
+// inode.
+func fileOwner(info os.FileInfo) (uid, gid, inode, links uint64, ok bool) {
+	return 0, 0, 0, 0, false
+}
+
+// systemShell returns the command line that runs line with the system
+// shell.
+func systemShell(line string) (string, []string) {
+	return "cmd", []string{"/c", line}
+}
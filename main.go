@@ -2,106 +2,226 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"os/user"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
 	"runtime/pprof"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
-	"github.com/chzyer/readline"
 )
 
 var (
 	history         []string
+	historyTimes    []time.Time
 	aliases         map[string]string
 	envVars         map[string]string
+	shellVars       map[string]string
+	bookmarks       map[string]string
+	dirVisits       map[string]*dirVisit
+	integerVars     map[string]bool
+	readonlyVars    map[string]bool
+	completionSpecs map[string]completionSpec
 	builtins        map[string]func([]string, io.Writer)
-	jobs            []*exec.Cmd
+	jobs            []*Job
+	foregroundJob   *Job
+	lastBgPid       int
+	lastJobID       int
+	lastDuration    time.Duration
 	mu              sync.Mutex
 	commandCache    map[string]string
 	cacheExpiration time.Duration = 5 * time.Minute
-	completer       *readline.PrefixCompleter
+	completer       *AutoCompleter
+	debugMode       bool
 
 	// Customization variables
-	shellBgOpacity   int
-	shellTextSize    int
-	shellTextColor   string
-	shellTextBold    bool
-	shellPromptStyle string
-
-	app      *tview.Application
-	textView *tview.TextView
-	input    string
+	shellBgOpacity        int
+	shellTextSize         int
+	shellTextColor        string
+	shellTextBold         bool
+	shellPromptStyle      string
+	shellIdleTimeout      time.Duration
+	shellCacheCommands    bool
+	shellKillJobsOnExit   bool
+	shellStatusBar        bool
+	shellTabWidth         int
+	shellBgLogfile        string
+	shellMathFloat        bool
+	shellLongCmdThreshold time.Duration
+	shellHistorySearchAll bool
+	shellCompletionMenu   bool
+	shellCompletionCase   string
+	shellJobsFormat       string
+	shellFallbackShell    bool
+	shellMotd             string
+	shellNotifyOnComplete bool
+	shellCompletionKey    tcell.Key
+	shellDoubleTab        bool
+	shellHistorySize      int
+
+	// shellOptions lists the options understood by the shell builtin.
+	shellOptions = []string{"bg-opacity", "text-size", "text-color", "text-bold", "prompt-style", "timeout", "cache-commands", "kill-jobs-on-exit", "statusbar", "tabwidth", "bg-logfile", "math-float", "long-cmd-threshold", "history-search-all", "completion-menu", "completion-case", "jobs-format", "fallback-shell", "motd", "notify-on-complete", "completion-key", "double-tab", "history-size"}
+
+	app       *tview.Application
+	layout    *tview.Flex
+	panes     *tview.Flex
+	shellView *tview.Flex
+	textView  *tview.TextView
+	inputView *inputLine
+	sidePane  *tview.TextView
+	stopWatch chan struct{}
+	statusBar *tview.TextView
+	input     string
+	cursor    int // position in input, counted in runes
+	// selectAnchor is where a mouse selection in the input line started, or
+	// -1 when nothing is selected. The selection spans to the cursor.
+	selectAnchor = -1
+	dragging     bool
+	// outputRegions counts the transcript regions holding command output
+	outputRegions int
+
+	// lineHandler, when set, receives entered lines instead of the command
+	// dispatcher. Builtins use it to read input interactively.
+	lineHandler func(line string)
+	linePrompt  string
+	// lineEOF is called when Ctrl-D is pressed in line mode
+	lineEOF   func()
+	idleTimer *time.Timer
 )
 
 func init() {
 	aliases = make(map[string]string)
 	envVars = make(map[string]string)
+	shellVars = make(map[string]string)
+	bookmarks = make(map[string]string)
+	dirVisits = make(map[string]*dirVisit)
+	integerVars = make(map[string]bool)
+	readonlyVars = make(map[string]bool)
+	completionSpecs = make(map[string]completionSpec)
 	commandCache = make(map[string]string)
 	builtins = map[string]func([]string, io.Writer){
-		"echo":    echoCommand,
-		"exit":    exitCommand,
-		"type":    typeCommand,
-		"pwd":     pwdCommand,
-		"cd":      cdCommand,
-		"whoami":  whoamiCommand,
-		"ls":      lsCommand,
-		"cat":     catCommand,
-		"touch":   touchCommand,
-		"rm":      rmCommand,
-		"mkdir":   mkdirCommand,
-		"rmdir":   rmdirCommand,
-		"history": historyCommand,
-		"clear":   clearCommand,
-		"alias":   aliasCommand,
-		"unalias": unaliasCommand,
-		"export":  exportCommand,
-		"unset":   unsetCommand,
-		"jobs":    jobsCommand,
-		"fg":      fgCommand,
-		"bg":      bgCommand,
-		"kill":    killCommand,
-		"shell":   shellCustomizationCommand,
+		"echo":           echoCommand,
+		"exit":           exitCommand,
+		"type":           typeCommand,
+		"pwd":            pwdCommand,
+		"cd":             cdCommand,
+		"whoami":         whoamiCommand,
+		"ls":             lsCommand,
+		"cat":            catCommand,
+		"touch":          touchCommand,
+		"rm":             rmCommand,
+		"mkdir":          mkdirCommand,
+		"rmdir":          rmdirCommand,
+		"history":        historyCommand,
+		"fc":             fcCommand,
+		"clear":          clearCommand,
+		"alias":          aliasCommand,
+		"unalias":        unaliasCommand,
+		"export":         exportCommand,
+		"unset":          unsetCommand,
+		"jobs":           jobsCommand,
+		"fg":             fgCommand,
+		"bg":             bgCommand,
+		"kill":           killCommand,
+		"shell":          shellCustomizationCommand,
+		"rehash":         rehashCommand,
+		"find":           findCommand,
+		"du":             duCommand,
+		"ps":             psCommand,
+		"killall-jobs":   killallJobsCommand,
+		"wait":           waitCommand,
+		"watch":          watchCommand,
+		"math":           mathCommand,
+		"bc":             bcCommand,
+		"dotenv":         dotenvCommand,
+		"source":         sourceCommand,
+		".":              sourceCommand,
+		"history-search": historySearchCommand,
+		"timeout":        timeoutCommand,
+		"yes":            yesCommand,
+		"sort":           sortCommand,
+		"grep":           grepCommand,
+		"wc":             wcCommand,
+		"head":           headCommand,
+		"tail":           tailCommand,
+		"basename":       basenameCommand,
+		"dirname":        dirnameCommand,
+		"realpath":       realpathCommand,
+		"readlink":       readlinkCommand,
+		"ln":             lnCommand,
+		"stat":           statCommand,
+		"chown":          chownCommand,
+		"local":          localCommand,
+		"declare":        declareCommand,
+		"typeset":        declareCommand,
+		"readonly":       readonlyCommand,
+		"bookmark":       bookmarkCommand,
+		"bookmarks":      bookmarksCommand,
+		"jump":           jumpCommand,
+		"z":              zCommand,
+		"reload":         reloadCommand,
+		"complete":       completeCommand,
 	}
 
 	// Default customization settings
-	shellBgOpacity = 100
-	shellTextSize = 12
-	shellTextColor = "white"
-	shellTextBold = false
-	shellPromptStyle = "default"
-
-	completer = readline.NewPrefixCompleter()
-	for _, cmd := range getAllCommands() {
-		completer.Children = append(completer.Children, readline.PcItem(cmd))
+	for _, option := range shellOptions {
+		resetShellOption(option)
 	}
 
+	completer = &AutoCompleter{}
+
 	go startCPUProfile()
 }
 
 func main() {
 	defer pprof.StopCPUProfile()
 
-	currentUser, err := user.Current()
-	if err != nil {
+	flag.BoolVar(&debugMode, "debug", false, "print diagnostics such as recovered panics")
+	noMotd := flag.Bool("no-motd", false, "do not show the welcome message at startup")
+	flag.Parse()
+
+	if _, err := user.Current(); err != nil {
 		fmt.Printf("Error getting current user: %v\n", err)
 		os.Exit(1)
 	}
 
-	homeDir := currentUser.HomeDir
+	homeDir := userHomeDir()
 
 	// Load aliases and environment variables from file
 	loadAliasesAndEnvVars(filepath.Join(homeDir, ".my_shell_aliases"))
 	loadEnvVars(filepath.Join(homeDir, ".my_shell_env"))
+	loadBookmarks(filepath.Join(homeDir, ".my_shell_bookmarks"))
+	loadDirVisits(filepath.Join(homeDir, ".my_shell_z"))
+	loadMotd(filepath.Join(homeDir, ".my_shell_motd"))
+	loadHistory(historyFilePath())
+
+	// TMOUT behaves like in bash: exit after that many idle seconds
+	if seconds, err := strconv.Atoi(os.Getenv("TMOUT")); err == nil && seconds > 0 {
+		shellIdleTimeout = time.Duration(seconds) * time.Second
+	}
+
+	// dyshell script [args...] runs the script and exits
+	if flag.NArg() > 0 {
+		os.Exit(runScriptFile(flag.Arg(0), flag.Args()[1:]))
+	}
 
 	// Initialize tcell screen
 	app = tview.NewApplication()
@@ -109,34 +229,117 @@ func main() {
 		SetDynamicColors(true).
 		SetRegions(true).
 		SetWordWrap(true).
-		SetChangedFunc(func() {
-			app.Draw()
+		SetChangedFunc(scheduleOutputDraw).
+		SetHighlightedFunc(func(added, removed, remaining []string) {
+			if len(added) > 0 {
+				copyToClipboard(textView.GetRegionText(added[0]))
+			}
 		})
 
-	textView.SetBorder(true).SetTitle("Dyshell")
+	// The input line is a region of its own below the transcript, so
+	// redrawing the prompt never disturbs earlier output
+	inputView = &inputLine{tview.NewTextView().SetDynamicColors(true).SetWrap(false)}
+	inputView.SetMouseCapture(handleInputMouse)
+	shellView = tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(textView, 0, 1, false).
+		AddItem(inputView, 1, 0, true)
+	shellView.SetBorder(true).SetTitle("Dyshell")
 
-	// Capture key events for input
-	textView.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+	statusBar = tview.NewTextView().SetDynamicColors(true)
+	panes = tview.NewFlex().AddItem(shellView, 0, 1, true)
+	layout = tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(panes, 0, 1, true).
+		AddItem(statusBar, 1, 0, false)
+
+	// Capture key events for input, wherever the focus is
+	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		resetIdleTimer()
+		keyDrawDeferred = true
+		if event.Key() == tcell.KeyCtrlC && event.Modifiers()&tcell.ModShift != 0 {
+			copySelection()
+			return nil
+		}
+		if event.Key() == tcell.KeyCtrlC && interruptForegroundJob() {
+			return nil
+		}
+		if lineHandler != nil {
+			switch event.Key() {
+			case tcell.KeyCtrlC:
+				fmt.Fprintln(textView, "^C")
+				setInput("")
+				stopLineMode()
+				updatePrompt()
+				return nil
+			case tcell.KeyCtrlD:
+				endLineInput()
+				updatePrompt()
+				return nil
+			}
+		}
+		selectAnchor = -1
+		if reverseSearch != nil && handleReverseSearchKey(event) {
+			updatePrompt()
+			return nil
+		}
+		if event.Key() == tcell.KeyCtrlR && lineHandler == nil {
+			closeCompletionMenu()
+			reverseSearch = &historySearch{original: input}
+			updatePrompt()
+			return nil
+		}
+		if completionMenu != nil && handleCompletionMenuKey(event) {
+			updatePrompt()
+			return nil
+		}
+		repeated := completionPressed
+		completionPressed = event.Key() == shellCompletionKey
+		if completionPressed {
+			completeAtCursor(repeated)
+			updatePrompt()
+			return nil
+		}
 		switch event.Key() {
 		case tcell.KeyEnter:
-			cmdLine := strings.TrimSpace(input)
-			fmt.Fprintln(textView, "") // Add newline before handling command
-			input = ""
-			handleCommand(cmdLine)
+			submitInput()
+		case tcell.KeyCtrlD:
+			// Ctrl-D on an empty line exits, as in other shells
+			if input == "" {
+				fmt.Fprintf(textView, "%sexit\n", promptPrefix())
+				exitCommand(nil, textView)
+			}
 		case tcell.KeyBackspace, tcell.KeyBackspace2:
-			if len(input) > 0 {
-				input = input[:len(input)-1]
+			if cursor > 0 {
+				line := []rune(input)
+				input = string(line[:cursor-1]) + string(line[cursor:])
+				cursor--
+			}
+		case tcell.KeyDelete:
+			line := []rune(input)
+			if cursor < len(line) {
+				input = string(line[:cursor]) + string(line[cursor+1:])
 			}
 		case tcell.KeyRune:
-			input += string(event.Rune())
+			insertInput(string(event.Rune()))
+		case tcell.KeyLeft:
+			if cursor > 0 {
+				cursor--
+			}
+		case tcell.KeyRight:
+			if cursor < len([]rune(input)) {
+				cursor++
+			}
+		case tcell.KeyHome, tcell.KeyCtrlA:
+			cursor = 0
+		case tcell.KeyEnd, tcell.KeyCtrlE:
+			cursor = len([]rune(input))
 		case tcell.KeyUp:
 			if len(history) > 0 {
 				if input == "" {
-					input = history[len(history)-1]
+					setInput(history[len(history)-1])
 				} else {
 					for i := len(history) - 1; i >= 0; i-- {
 						if history[i] == input && i > 0 {
-							input = history[i-1]
+							setInput(history[i-1])
 							break
 						}
 					}
@@ -146,25 +349,39 @@ func main() {
 			if len(history) > 0 {
 				for i := 0; i < len(history); i++ {
 					if history[i] == input && i < len(history)-1 {
-						input = history[i+1]
+						setInput(history[i+1])
 						break
 					}
 				}
 			}
+		case tcell.KeyCtrlZ:
+			suspendForegroundJob()
 		case tcell.KeyTab:
-			suggestions, _ := completer.Do([]rune(input), len(input))
-			if len(suggestions) > 0 {
-				input = string(suggestions[0])
-			}
+			// Only reached when completion is bound to another key
+			insertInput("\t")
+		default:
+			return event
 		}
 		updatePrompt()
 		return nil
 	})
 
+	if !*noMotd {
+		showMotd(textView)
+	}
+	sourceRCFile(textView)
+
 	// Initial prompt
 	updatePrompt()
+	resetIdleTimer()
+	handleReloadSignal()
 
-	if err := app.SetRoot(textView, true).EnableMouse(true).Run(); err != nil {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		panic(err)
+	}
+	app.SetScreen(debouncedScreen{screen})
+	if err := app.SetRoot(layout, true).EnableMouse(true).EnablePaste(true).Run(); err != nil {
 		panic(err)
 	}
 }
@@ -176,9 +393,7 @@ func getAllCommands() []string {
 		commands = append(commands, cmd)
 	}
 
-	pathEnv := os.Getenv("PATH")
-	paths := strings.Split(pathEnv, string(os.PathListSeparator))
-	for _, path := range paths {
+	for _, path := range searchPath() {
 		files, err := os.ReadDir(path)
 		if err != nil {
 			continue
@@ -196,664 +411,6558 @@ func updatePrompt() {
 	if err != nil {
 		currentDir = "~"
 	}
-	// Clear current line and set prompt and input
-	textView.Clear()
-	fmt.Fprintf(textView, "%s %s%s_", currentDir, getPrompt(), input)
+	inputView.Clear()
+	if reverseSearch != nil {
+		fmt.Fprint(inputView, reverseSearch.render())
+	} else {
+		fmt.Fprintf(inputView, "%s%s", promptPrefix(), renderInput())
+	}
+	updateStatusBar(currentDir)
 }
 
-func getPrompt() string {
-	return "> "
+// promptPrefix returns the tagged text shown in front of the input line.
+// A prompt-style other than "default" is used as a template, see
+// expandPromptTemplate.
+func promptPrefix() string {
+	if lineHandler != nil {
+		return tview.Escape(linePrompt)
+	}
+	currentDir, err := os.Getwd()
+	if err != nil {
+		currentDir = "~"
+	}
+	if shellPromptStyle != "default" {
+		return expandPromptTemplate(shellPromptStyle, currentDir)
+	}
+	return tview.Escape(currentDir + " " + getPrompt())
 }
 
-func handleCommand(cmdLine string) {
-	cmdLine = strings.TrimSpace(cmdLine)
-	if cmdLine == "" {
-		updatePrompt()
-		return
+// expandPromptTemplate renders a prompt template into tagged text. It
+// understands these escapes:
+//
+//	\w  current directory
+//	\u  user name
+//	\h  host name
+//	\?  green check or red cross with the status of the last command
+//	\j  number of running background jobs
+//	\D  "took 3.2s" when the last command ran longer than long-cmd-threshold
+//	\\  a literal backslash
+func expandPromptTemplate(template, currentDir string) string {
+	// Literal text is collected and escaped as a whole, so that brackets
+	// typed in separate pieces cannot combine into a style tag
+	var b, text strings.Builder
+	literal := func(s string) {
+		text.WriteString(s)
 	}
-
-	// Save command to history
-	mu.Lock()
-	history = append(history, cmdLine)
-	mu.Unlock()
-
-	// Perform command substitution
-	cmdLine = substituteCommand(cmdLine)
-
-	// Expand environment variables
-	cmdLine = os.ExpandEnv(cmdLine)
-
-	// Check for multiline command
-	if strings.HasSuffix(cmdLine, "\\") {
-		input += "\n"
-		updatePrompt()
-		return
+	tag := func(s string) {
+		b.WriteString(tview.Escape(text.String()))
+		text.Reset()
+		b.WriteString(s)
 	}
-
-	// Check for piped commands
-	if strings.Contains(cmdLine, "|") {
-		executePipedCommands(cmdLine)
-		fmt.Fprintln(textView, "") // Ensure a newline is printed after execution
-		updatePrompt()
-		return
+	for i := 0; i < len(template); i++ {
+		if template[i] != '\\' || i+1 == len(template) {
+			literal(template[i : i+1])
+			continue
+		}
+		i++
+		switch template[i] {
+		case 'w':
+			literal(currentDir)
+		case 'u':
+			if u, err := user.Current(); err == nil {
+				literal(u.Username)
+			}
+		case 'h':
+			if host, err := os.Hostname(); err == nil {
+				literal(host)
+			}
+		case '?':
+			if exitStatus() == 0 {
+				tag("[green]✓[-]")
+			} else {
+				tag(fmt.Sprintf("[red]✗ %d[-]", exitStatus()))
+			}
+		case 'j':
+			literal(strconv.Itoa(runningJobCount()))
+		case 'D':
+			mu.Lock()
+			duration := lastDuration
+			mu.Unlock()
+			if duration > shellLongCmdThreshold {
+				literal("took " + duration.Round(100*time.Millisecond).String())
+			}
+		case '\\':
+			literal("\\")
+		default:
+			literal(template[i-1 : i+1])
+		}
 	}
+	tag("")
+	return b.String()
+}
 
-	// Capture output
-	output := new(strings.Builder)
-	writer := io.MultiWriter(output, textView)
-
-	// Execute built-in command
-	args := strings.Split(cmdLine, " ")
-	cmd := args[0]
-
-	// Check for aliases
-	if aliasCmd, ok := aliases[cmd]; ok {
-		cmd = aliasCmd
-		args = append([]string{cmd}, args[1:]...)
+// renderInput returns the input line as tagged text, syntax highlighted,
+// with the character under the cursor in reverse video and any selection
+// highlighted.
+func renderInput() string {
+	line := append([]rune(input), ' ')
+	colors := make([]string, len(line))
+	if lineHandler == nil {
+		colors = highlightInput(line)
 	}
+	selStart, selEnd := selectionRange()
+	style := func(i int) string {
+		fg, bg, attr := colors[i], "-", "-"
+		if fg == "" {
+			fg = "-"
+		}
+		switch {
+		case i == cursor:
+			attr = "r"
+		case i >= selStart && i < selEnd:
+			fg, bg = "-", "gray"
+		}
+		return "[" + fg + ":" + bg + ":" + attr + "]"
+	}
+	var b strings.Builder
+	for start := 0; start < len(line); {
+		end := start + 1
+		for end < len(line) && style(end) == style(start) {
+			end++
+		}
+		b.WriteString(style(start) + tview.Escape(string(line[start:end])))
+		start = end
+	}
+	b.WriteString("[-:-:-]")
+	return b.String()
+}
 
-	if builtinFunc, ok := builtins[cmd]; ok {
-		builtinFunc(args[1:], writer)
-	} else {
-		// Check for background job
-		if strings.HasSuffix(cmdLine, "&") {
-			cmdLine = strings.TrimSuffix(cmdLine, "&")
-			args = strings.Fields(cmdLine)
-			cmd := exec.Command(args[0], args[1:]...)
-			cmd.Stdout = writer
-			cmd.Stderr = writer
-			err := cmd.Start()
-			if err == nil {
-				mu.Lock()
-				jobs = append(jobs, cmd)
-				mu.Unlock()
-				fmt.Fprintf(writer, "[%d] %d\n", len(jobs), cmd.Process.Pid)
-			} else {
-				fmt.Fprintf(writer, "%s: %v\n", cmd.Args[0], err)
+// highlightInput returns the color of every rune in line, like fish does:
+// command names are green when they can be run and red when they cannot,
+// quoted strings are yellow, operators and redirections aqua and comments
+// gray. Runes left plain get "".
+func highlightInput(line []rune) []string {
+	colors := make([]string, len(line))
+	isOperator := func(c rune) bool { return strings.ContainsRune("|&;<>", c) }
+	isSpace := func(c rune) bool { return c == ' ' || c == '\t' }
+	commandPosition := true
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case isSpace(c):
+			i++
+		case c == '#' && (i == 0 || isSpace(line[i-1])):
+			for ; i < len(line); i++ {
+				colors[i] = "gray"
 			}
-		} else {
-			// Check for redirection
-			if strings.Contains(cmdLine, ">") || strings.Contains(cmdLine, "<") {
-				executeRedirectedCommand(cmdLine, writer)
-			} else {
-				// Search for the command in PATH and execute it
-				pathEnv := os.Getenv("PATH")
-				paths := strings.Split(pathEnv, string(os.PathListSeparator))
-				found := false
-				for _, path := range paths {
-					fullPath := filepath.Join(path, cmd)
-					if _, err := os.Stat(fullPath); err == nil {
-						cacheCommandPath(cmd, fullPath)
-						executeExternalCommand(fullPath, args[1:], writer)
-						found = true
-						break
+		case c == '!' && i == 0:
+			// !cmd hands the line to the system shell
+			colors[i] = "aqua"
+			i++
+		case isOperator(c) || (c >= '0' && c <= '9' && i+1 < len(line) && line[i+1] == '>' && (i == 0 || isSpace(line[i-1]))):
+			start := i
+			if !isOperator(c) {
+				i++
+			}
+			for i < len(line) && isOperator(line[i]) {
+				i++
+			}
+			op := string(line[start:i])
+			if strings.HasSuffix(op, ">&") {
+				for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+					i++
+				}
+			}
+			for j := start; j < i; j++ {
+				colors[j] = "aqua"
+			}
+			// A redirection is followed by a file name, anything else
+			// by another command
+			commandPosition = !strings.ContainsAny(op, "<>")
+		default:
+			start := i
+			var word strings.Builder
+			var quote rune
+			for ; i < len(line); i++ {
+				c := line[i]
+				if quote == 0 && (isSpace(c) || isOperator(c)) {
+					break
+				}
+				switch {
+				case quote != 0:
+					colors[i] = "yellow"
+					if c == quote {
+						quote = 0
+					} else {
+						word.WriteRune(c)
 					}
+				case c == '\'' || c == '"':
+					colors[i] = "yellow"
+					quote = c
+				case c == '\\' && i+1 < len(line):
+					i++
+					word.WriteRune(line[i])
+				default:
+					word.WriteRune(c)
 				}
-				if !found {
-					fmt.Fprintf(writer, "%s: command not found\n", cmd)
+			}
+			if !commandPosition {
+				break
+			}
+			color := "red"
+			if isKnownCommand(word.String()) {
+				color = "green"
+			}
+			for j := start; j < i; j++ {
+				if colors[j] == "" {
+					colors[j] = color
 				}
 			}
+			commandPosition = false
 		}
 	}
-
-	fmt.Fprintln(textView, output.String()) // Print output to the text view and ensure newline
-	fmt.Fprintln(textView, "")              // Ensure newline after the command execution
-	// Display prompt again
-	updatePrompt()
+	return colors
 }
 
-func executeBuiltinCommand(cmd string, args []string, writer io.Writer) {
-	if builtinFunc, ok := builtins[cmd]; ok {
-		builtinFunc(args, writer)
-	} else {
-		fmt.Fprintf(writer, "%s: command not found\n", cmd)
+// isKnownCommand reports whether name is a builtin, an alias or a program
+// that can be run. Programs in PATH are looked up in pathCommands, as this
+// is checked on every keystroke.
+func isKnownCommand(name string) bool {
+	if _, ok := builtins[name]; ok {
+		return true
+	}
+	if _, ok := aliases[name]; ok {
+		return true
 	}
+	if strings.ContainsRune(name, '/') || strings.ContainsRune(name, filepath.Separator) {
+		info, err := os.Stat(expandTilde(name))
+		return err == nil && !info.IsDir()
+	}
+	return pathCommands.has(name)
 }
 
-func echoCommand(args []string, writer io.Writer) {
-	fmt.Fprintln(writer, strings.Join(args, " "))
-}
+// pathCommands caches the names of the programs in PATH. It is reloaded
+// when PATH changes, when the cache expires and after hash -r.
+var pathCommands commandSet
 
-func exitCommand(args []string, writer io.Writer) {
-	saveAliasesAndEnvVars(filepath.Join(userHomeDir(), ".my_shell_aliases"))
-	saveEnvVars(filepath.Join(userHomeDir(), ".my_shell_env"))
-	os.Exit(0)
+type commandSet struct {
+	sync.Mutex
+	names  map[string]bool
+	path   string
+	loaded time.Time
 }
 
-func typeCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		arg := args[0]
-		if _, ok := builtins[arg]; ok {
-			fmt.Fprintf(writer, "%s is a shell builtin\n", arg)
-		} else if path, found := getCachedCommandPath(arg); found {
-			fmt.Fprintf(writer, "%s is %s\n", arg, path)
-		} else {
-			pathEnv := os.Getenv("PATH")
-			paths := strings.Split(pathEnv, string(os.PathListSeparator))
-			found := false
-			for _, path := range paths {
-				fullPath := filepath.Join(path, arg)
-				if _, err := os.Stat(fullPath); err == nil {
-					fmt.Fprintf(writer, "%s is %s\n", arg, fullPath)
-					cacheCommandPath(arg, fullPath)
-					found = true
-					break
-				}
+func (s *commandSet) has(name string) bool {
+	s.Lock()
+	defer s.Unlock()
+	path := os.Getenv("PATH")
+	if s.names == nil || s.path != path || time.Since(s.loaded) > cacheExpiration {
+		s.names = make(map[string]bool)
+		for _, dir := range searchPath() {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				continue
 			}
-			if !found {
-				fmt.Fprintf(writer, "%s not found\n", arg)
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					s.names[entry.Name()] = true
+				}
 			}
 		}
+		s.path, s.loaded = path, time.Now()
 	}
+	return s.names[name]
 }
 
-func pwdCommand(args []string, writer io.Writer) {
-	dir, err := os.Getwd()
-	if err != nil {
-		fmt.Fprintf(writer, "Error: %v\n", err)
-	} else {
-		fmt.Fprintln(writer, dir)
-	}
+func (s *commandSet) reset() {
+	s.Lock()
+	s.names = nil
+	s.Unlock()
 }
 
-func cdCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		dir := args[0]
-		if dir == "~" {
-			dir = userHomeDir()
-		}
-		err := os.Chdir(dir)
-		if err != nil {
-			fmt.Fprintf(writer, "cd: %s: No such file or directory\n", dir)
-		}
-		updatePrompt()
-	} else {
-		os.Chdir(userHomeDir())
-		updatePrompt()
+// copySelection copies the selected part of the input line or, failing
+// that, the highlighted command output in the transcript.
+func copySelection() {
+	if start, end := selectionRange(); start != end {
+		copyToClipboard(string([]rune(input)[start:end]))
+		return
+	}
+	if highlights := textView.GetHighlights(); len(highlights) > 0 {
+		copyToClipboard(textView.GetRegionText(highlights[0]))
 	}
 }
 
-func whoamiCommand(args []string, writer io.Writer) {
-	user, err := user.Current()
-	if err != nil {
-		fmt.Fprintf(writer, "Error: %v\n", err)
-	} else {
-		fmt.Fprintln(writer, user.Username)
+// copyToClipboard puts text on the system clipboard with the OSC 52 escape
+// sequence. The terminal performs the copy, so it also works over SSH.
+func copyToClipboard(text string) {
+	if text == "" {
+		return
 	}
+	fmt.Fprintf(os.Stdout, "\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(text)))
 }
 
-func lsCommand(args []string, writer io.Writer) {
-	path := "."
-	if len(args) > 0 {
-		path = args[0]
-	}
-	files, err := os.ReadDir(path)
-	if err != nil {
-		fmt.Fprintf(writer, "ls: cannot access '%s': %v\n", path, err)
-		return
+// selectionRange returns the selected part of the input as a half-open
+// range of rune indices, which is empty when nothing is selected.
+func selectionRange() (int, int) {
+	if selectAnchor < 0 || selectAnchor == cursor {
+		return 0, 0
 	}
-	for _, file := range files {
-		info, err := file.Info()
-		if err != nil {
-			continue
-		}
-		modTime := info.ModTime().Format("Jan 02 15:04")
-		size := info.Size()
-		fmt.Fprintf(writer, "%-20s %10d %s\n", file.Name(), size, modTime)
+	if selectAnchor < cursor {
+		return selectAnchor, cursor
 	}
+	return cursor, selectAnchor
 }
 
-func catCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		for _, file := range args {
-			data, err := os.ReadFile(file)
-			if err != nil {
-				fmt.Fprintf(writer, "cat: cannot read '%s': %v\n", file, err)
-				continue
-			}
-			fmt.Fprint(writer, string(data))
+// handleInputMouse moves the cursor to where the input line is clicked and
+// selects text when the mouse is dragged across it.
+func handleInputMouse(action tview.MouseAction, event *tcell.EventMouse) (tview.MouseAction, *tcell.EventMouse) {
+	x, _ := event.Position()
+	innerX, _, _, _ := inputView.GetInnerRect()
+	column := x - innerX - tview.TaggedStringWidth(promptPrefix())
+
+	// Translate the screen column into a rune index, minding wide runes
+	line := []rune(input)
+	pos := 0
+	for width := 0; pos < len(line); pos++ {
+		width += tview.TaggedStringWidth(tview.Escape(string(line[pos])))
+		if width > column {
+			break
 		}
-	} else {
-		fmt.Fprintln(writer, "cat: missing file operand")
 	}
-}
 
-func touchCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		for _, file := range args {
-			f, err := os.Create(file)
-			if err != nil {
-				fmt.Fprintf(writer, "touch: cannot create '%s': %v\n", file, err)
-				continue
-			}
-			f.Close()
+	switch action {
+	case tview.MouseLeftDown:
+		cursor = pos
+		selectAnchor = pos
+		dragging = true
+	case tview.MouseMove:
+		if !dragging {
+			return action, event
 		}
-	} else {
-		fmt.Fprintln(writer, "touch: missing file operand")
+		cursor = pos
+	case tview.MouseLeftUp:
+		dragging = false
+		if start, end := selectionRange(); start != end {
+			copyToClipboard(string(line[start:end]))
+		}
+	default:
+		return action, event
 	}
+	updatePrompt()
+	return tview.MouseConsumed, nil
 }
 
-func rmCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		for _, file := range args {
-			err := os.Remove(file)
-			if err != nil {
-				fmt.Fprintf(writer, "rm: cannot remove '%s': %v\n", file, err)
-				continue
-			}
-		}
-	} else {
-		fmt.Fprintln(writer, "rm: missing file operand")
+// updateStatusBar shows the last exit status, the number of running jobs and
+// the current directory below the transcript.
+func updateStatusBar(currentDir string) {
+	if statusBar == nil || !shellStatusBar {
+		return
 	}
+	statusColor := "green"
+	if exitStatus() != 0 {
+		statusColor = "red"
+	}
+	statusBar.Clear()
+	fmt.Fprintf(statusBar, " status: [%s]%d[-] | jobs: %d | %s", statusColor, exitStatus(),
+		runningJobCount(), tview.Escape(currentDir))
 }
 
-func mkdirCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		for _, dir := range args {
-			err := os.Mkdir(dir, 0755)
-			if err != nil {
-				fmt.Fprintf(writer, "mkdir: cannot create directory '%s': %v\n", dir, err)
-				continue
-			}
-		}
+// showStatusBar shows or hides the status bar.
+func showStatusBar(show bool) {
+	if layout == nil {
+		return
+	}
+	if show {
+		layout.ResizeItem(statusBar, 1, 0)
 	} else {
-		fmt.Fprintln(writer, "mkdir: missing directory operand")
+		statusBar.Clear()
+		layout.ResizeItem(statusBar, 0, 0)
 	}
 }
 
-func rmdirCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		for _, dir := range args {
-			err := os.Remove(dir)
-			if err != nil {
-				fmt.Fprintf(writer, "rmdir: cannot remove directory '%s': %v\n", dir, err)
-				continue
-			}
-		}
-	} else {
-		fmt.Fprintln(writer, "rmdir: missing directory operand")
+// submitInput runs the input line as a command, or hands it to the line
+// mode handler if there is one.
+func submitInput() {
+	if lineHandler != nil {
+		line := input
+		fmt.Fprintf(textView, "%s%s\n", promptPrefix(), tview.Escape(line))
+		setInput("")
+		lineHandler(line)
+		return
 	}
+	cmdLine := strings.TrimSpace(input)
+	// Echo the command into the transcript and wrap its output in a
+	// region, so clicking the output selects it for copying
+	fmt.Fprintf(textView, "%s%s\n", promptPrefix(), tview.Escape(cmdLine))
+	outputRegions++
+	fmt.Fprintf(textView, `["out%d"]`, outputRegions)
+	setInput("")
+	handleCommand(cmdLine)
+	fmt.Fprint(textView, `[""]`)
 }
 
-func historyCommand(args []string, writer io.Writer) {
-	mu.Lock()
-	for i, cmd := range history {
-		fmt.Fprintf(writer, "%d %s\n", i+1, cmd)
-	}
-	mu.Unlock()
+// insertInput inserts text into the input line at the cursor.
+func insertInput(text string) {
+	line := []rune(input)
+	input = string(line[:cursor]) + text + string(line[cursor:])
+	cursor += len([]rune(text))
 }
 
-func clearCommand(args []string, writer io.Writer) {
-	cmd := exec.Command("clear")
-	cmd.Stdout = writer
-	cmd.Run()
+// inputLine is the view showing the prompt and the input line. It takes a
+// bracketed paste as a whole, so pasting is a single redraw instead of one
+// for every character typed.
+type inputLine struct {
+	*tview.TextView
 }
 
-func aliasCommand(args []string, writer io.Writer) {
-	if len(args) == 0 {
-		mu.Lock()
-		for k, v := range aliases {
-			fmt.Fprintf(writer, "alias %s='%s'\n", k, v)
+// PasteHandler inserts pasted text at the cursor. Every complete line in
+// it is submitted, as if it had been typed followed by Enter.
+func (l *inputLine) PasteHandler() func(text string, setFocus func(p tview.Primitive)) {
+	return l.WrapPasteHandler(func(text string, setFocus func(p tview.Primitive)) {
+		lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+		for i, line := range lines {
+			insertInput(line)
+			if i < len(lines)-1 {
+				submitInput()
+			}
 		}
-		mu.Unlock()
+		updatePrompt()
+	})
+}
+
+// startLineMode sends entered lines to handler, shown with prompt, until
+// stopLineMode is called. Ctrl-D calls eof or, if that is nil, leaves line
+// mode. Ctrl-C always leaves it.
+func startLineMode(prompt string, handler func(line string), eof func()) {
+	linePrompt = prompt
+	lineHandler = handler
+	lineEOF = eof
+}
+
+func stopLineMode() {
+	lineHandler = nil
+	linePrompt = ""
+	lineEOF = nil
+}
+
+// endLineInput handles Ctrl-D in line mode. Text already typed is entered
+// as the last line.
+func endLineInput() {
+	if input != "" {
+		submitInput()
+	}
+	if lineEOF != nil {
+		lineEOF()
 	} else {
-		for _, alias := range args {
-			parts := strings.SplitN(alias, "=", 2)
-			if len(parts) == 2 {
-				mu.Lock()
-				aliases[parts[0]] = strings.Trim(parts[1], "'\"")
-				mu.Unlock()
+		stopLineMode()
+	}
+}
+
+// historySearch is the state of a Ctrl-R search through the history.
+type historySearch struct {
+	query    string
+	matches  []string // entries containing query, newest first
+	index    int      // the match shown
+	original string   // the input line from before the search
+}
+
+// reverseSearch is the Ctrl-R search in progress, or nil.
+var reverseSearch *historySearch
+
+// match returns the entry currently found, or "" if there is none.
+func (search *historySearch) match() string {
+	if search.index < len(search.matches) {
+		return search.matches[search.index]
+	}
+	return ""
+}
+
+// setQuery searches again for query, starting from the newest entry.
+func (search *historySearch) setQuery(query string) {
+	search.query = query
+	search.index = 0
+	search.matches = nil
+	if query != "" {
+		search.matches = searchHistory(query)
+	}
+}
+
+// render returns the tagged text shown in place of the prompt and input
+// line while searching, as bash shows it.
+func (search *historySearch) render() string {
+	label := "reverse-i-search"
+	if search.query != "" && len(search.matches) == 0 {
+		label = "failed " + label
+	}
+	return tview.Escape(fmt.Sprintf("(%s)`%s': %s", label, search.query, search.match()))
+}
+
+// handleReverseSearchKey handles a key pressed while searching the history.
+// Typing refines the query and Ctrl-R moves on to older matches. Enter puts
+// the match into the input line and Escape or Ctrl-C restores the line from
+// before the search. Any other key also takes the match and is handled as
+// usual, so it returns false.
+func handleReverseSearchKey(event *tcell.EventKey) bool {
+	search := reverseSearch
+	switch event.Key() {
+	case tcell.KeyRune:
+		search.setQuery(search.query + string(event.Rune()))
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if query := []rune(search.query); len(query) > 0 {
+			search.setQuery(string(query[:len(query)-1]))
+		}
+	case tcell.KeyCtrlR:
+		if search.index+1 < len(search.matches) {
+			search.index++
+		}
+	case tcell.KeyEscape, tcell.KeyCtrlC, tcell.KeyCtrlG:
+		reverseSearch = nil
+		setInput(search.original)
+	case tcell.KeyEnter:
+		reverseSearch = nil
+		if match := search.match(); match != "" {
+			setInput(match)
+		}
+	default:
+		reverseSearch = nil
+		if match := search.match(); match != "" {
+			setInput(match)
+		}
+		return false
+	}
+	return true
+}
+
+// setInput replaces the input line and moves the cursor to its end.
+func setInput(line string) {
+	input = line
+	cursor = len([]rune(line))
+}
+
+// completionPressed is set while the last key pressed was the completion
+// key, so that pressing it twice can be told apart from pressing it once.
+var completionPressed bool
+
+// completeAtCursor completes the word under the cursor, replacing the whole
+// word while leaving the rest of the line untouched. When there are several
+// candidates, it first completes as far as all of them agree, as bash does.
+// Only once that adds nothing are they offered: in the menu, by taking the
+// first one, or with double-tab set by listing them on the next press.
+func completeAtCursor(repeated bool) {
+	line := []rune(input)
+	suggestions, length := completer.Do(line, cursor)
+	if len(suggestions) == 0 {
+		return
+	}
+	if len(suggestions) > 1 {
+		if prefix := commonPrefix(suggestions); len(prefix) > length {
+			applyCompletion(prefix, length)
+			return
+		}
+	}
+	if shellDoubleTab && len(suggestions) > 1 {
+		if !repeated {
+			return
+		}
+		if shellCompletionMenu {
+			openCompletionMenu(suggestions, length)
+			return
+		}
+		listCompletions(suggestions)
+		return
+	}
+	if shellCompletionMenu && len(suggestions) > 1 {
+		openCompletionMenu(suggestions, length)
+		return
+	}
+	applyCompletion(suggestions[0], length)
+}
+
+// commonPrefix returns the longest prefix shared by all candidates.
+func commonPrefix(candidates [][]rune) []rune {
+	prefix := candidates[0]
+	for _, candidate := range candidates[1:] {
+		n := 0
+		for n < len(prefix) && n < len(candidate) && prefix[n] == candidate[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return prefix
+}
+
+// listCompletions prints the candidates below the line being completed,
+// which is then shown again at the prompt.
+func listCompletions(candidates [][]rune) {
+	labels := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		labels[i] = string(candidate)
+	}
+	fmt.Fprintf(textView, "%s%s\n", promptPrefix(), tview.Escape(input))
+	fmt.Fprintln(textView, tview.Escape(strings.Join(labels, "  ")))
+}
+
+// parseKeyName returns the key named name, as tcell names keys, ignoring
+// case.
+func parseKeyName(name string) (tcell.Key, bool) {
+	for key, keyName := range tcell.KeyNames {
+		if strings.EqualFold(keyName, name) {
+			return key, true
+		}
+	}
+	return 0, false
+}
+
+// applyCompletion replaces the word under the cursor, whose first length
+// runes precede the cursor, with candidate.
+func applyCompletion(candidate []rune, length int) {
+	line := []rune(input)
+	end := cursor
+	for end < len(line) && line[end] != ' ' {
+		end++
+	}
+	start := cursor - length
+	completed := string(line[:start]) + string(candidate)
+	input = completed + string(line[end:])
+	cursor = len([]rune(completed))
+}
+
+// completionMenuMaxRows limits the height of the completion menu; the
+// remaining candidates scroll into view as the selection moves.
+const completionMenuMaxRows = 10
+
+var (
+	// completionMenu is the grid of candidates shown above the input line
+	// while menu completion is in progress, or nil.
+	completionMenu       *tview.Table
+	completionCandidates [][]rune
+	completionLength     int
+)
+
+// openCompletionMenu lays candidates out in a grid between the transcript
+// and the input line, where they can be chosen with the arrow keys.
+func openCompletionMenu(candidates [][]rune, length int) {
+	closeCompletionMenu()
+	labels := make([]string, len(candidates))
+	width := 0
+	for i, candidate := range candidates {
+		labels[i] = string(candidate)
+		if annotation := completionAnnotation(labels[i]); annotation != "" {
+			labels[i] += "  (" + annotation + ")"
+		}
+		if n := len([]rune(labels[i])); n > width {
+			width = n
+		}
+	}
+	_, _, viewWidth, _ := textView.GetInnerRect()
+	columns := viewWidth / (width + 2)
+	if columns < 1 {
+		columns = 1
+	}
+	rows := (len(candidates) + columns - 1) / columns
+
+	completionMenu = tview.NewTable().SetSelectable(true, true)
+	for i, label := range labels {
+		completionMenu.SetCell(i/columns, i%columns, tview.NewTableCell(tview.Escape(label)).SetExpansion(1))
+	}
+	completionCandidates = candidates
+	completionLength = length
+	shellView.RemoveItem(inputView)
+	shellView.AddItem(completionMenu, min(rows, completionMenuMaxRows), 0, false)
+	shellView.AddItem(inputView, 1, 0, true)
+}
+
+func closeCompletionMenu() {
+	if completionMenu != nil {
+		shellView.RemoveItem(completionMenu)
+		completionMenu = nil
+		completionCandidates = nil
+	}
+}
+
+// handleCompletionMenuKey moves through the completion menu with the arrow
+// keys and Tab, inserts the selected candidate on Enter and closes the menu
+// on Escape. Any other key closes the menu and is handled as usual, so it
+// returns false.
+func handleCompletionMenuKey(event *tcell.EventKey) bool {
+	row, column := completionMenu.GetSelection()
+	columns := completionMenu.GetColumnCount()
+	index := row*columns + column
+	switch event.Key() {
+	case tcell.KeyLeft:
+		index--
+	case tcell.KeyRight, tcell.KeyTab:
+		index++
+	case tcell.KeyBacktab:
+		index--
+	case tcell.KeyUp:
+		index -= columns
+	case tcell.KeyDown:
+		index += columns
+	case tcell.KeyEnter:
+		applyCompletion(completionCandidates[index], completionLength)
+		closeCompletionMenu()
+		return true
+	case tcell.KeyEscape:
+		closeCompletionMenu()
+		return true
+	default:
+		closeCompletionMenu()
+		return false
+	}
+	// Wrap around at either end, as zsh's menu-select does
+	count := len(completionCandidates)
+	index = (index%count + count) % count
+	completionMenu.Select(index/columns, index%columns)
+	return true
+}
+
+func getPrompt() string {
+	return "> "
+}
+
+func handleCommand(cmdLine string) {
+	// A bug in a single command should not take the whole TUI down with it.
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(textView, "dyshell: internal error: %v\n", r)
+			if debugMode {
+				fmt.Fprintf(textView, "%s\n", debug.Stack())
 			}
+			updatePrompt()
 		}
+	}()
+
+	cmdLine = strings.TrimSpace(cmdLine)
+	if cmdLine == "" {
+		updatePrompt()
+		return
 	}
+
+	start := time.Now()
+	defer func() {
+		setLastDuration(time.Since(start))
+	}()
+
+	// Save command to history
+	mu.Lock()
+	history = append(history, cmdLine)
+	historyTimes = append(historyTimes, time.Now())
+	mu.Unlock()
+
+	runLine(cmdLine)
+	updatePrompt()
 }
 
-func unaliasCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		for _, alias := range args {
+// runLine runs a line of input, as typed at the prompt or read from a
+// script file.
+func runLine(cmdLine string) {
+	// Drop comments, which stay in the history like in other shells
+	cmdLine = stripComment(cmdLine)
+	if cmdLine == "" {
+		return
+	}
+
+	// !cmd hands the rest of the line to the system shell untouched
+	if rest, ok := strings.CutPrefix(cmdLine, "!"); ok && strings.TrimSpace(rest) != "" {
+		afterForeground(func() {
+			runInSystemShell(rest, newDisplayWriter())
+			afterForeground(endCommandOutput)
+		})
+		return
+	}
+
+	// Commands separated by ; run one after the other, whatever their
+	// exit status. Each one waits for the foreground job started by the
+	// one before it.
+	for _, command := range splitUnquoted(cmdLine, ';') {
+		if command = strings.TrimSpace(command); command != "" {
+			afterForeground(func() { runCommand(command) })
+		}
+	}
+}
+
+// runCommand expands and runs a single command, as handleCommand does for
+// every command of a line.
+func runCommand(cmdLine string) {
+	rawLine := cmdLine
+
+	// Perform arithmetic expansion, before $(...) can mistake it for a
+	// command substitution
+	cmdLine, err := expandArithmetic(cmdLine)
+	if err != nil {
+		setExitStatus(1)
+		fmt.Fprintf(textView, "dyshell: %v\n", err)
+		updatePrompt()
+		return
+	}
+
+	// A lone NAME=value assigns a shell variable. It is recognised before
+	// expansion so that the output of VAR=$(cmd) is stored rather than run.
+	if name, value, ok := parseAssignment(cmdLine); ok {
+		setExitStatus(0)
+		if err := setVariable(name, value); err != nil {
+			setExitStatus(1)
+			fmt.Fprintf(textView, "dyshell: %v\n", err)
+		}
+		updatePrompt()
+		return
+	}
+
+	// Perform command substitution and expand variables, leaving single
+	// quoted text alone
+	cmdLine = strings.TrimSpace(expandWords(cmdLine))
+	if cmdLine == "" {
+		updatePrompt()
+		return
+	}
+
+	// A --dry-run prefix prints the fully expanded command instead of
+	// running it
+	if rest, ok := strings.CutPrefix(cmdLine, "--dry-run "); ok {
+		setExitStatus(0)
+		if words, err := tokenize(rest); err != nil {
+			setExitStatus(2)
+			fmt.Fprintf(textView, "dyshell: %v\n", err)
+		} else if len(words) > 0 {
+			fmt.Fprintln(textView, strings.Join(expandAlias(words), " "))
+		}
+		updatePrompt()
+		return
+	}
+
+	// Check for multiline command
+	if strings.HasSuffix(cmdLine, "\\") {
+		setInput(input + "\n")
+		updatePrompt()
+		return
+	}
+
+	writer := newDisplayWriter()
+
+	// Check for piped commands
+	if len(splitUnquoted(cmdLine, '|')) > 1 {
+		executePipedCommands(cmdLine, writer)
+		// The pipeline keeps running; finish the line once it is done
+		afterForeground(func() {
+			endCommandOutput()
+			updatePrompt()
+		})
+		return
+	}
+
+	// Execute built-in command
+	args, err := tokenize(cmdLine)
+	if err != nil {
+		setExitStatus(2)
+		fmt.Fprintf(textView, "dyshell: %v\n", err)
+		updatePrompt()
+		return
+	}
+	if len(args) == 0 {
+		updatePrompt()
+		return
+	}
+
+	// Redirections are taken off the line before the command is looked
+	// up, so that they apply to builtins and external commands alike.
+	// "cat > file" is left to cat, which reads the text interactively.
+	var redirect *redirection
+	capture := false
+	if args[0] == "cat" {
+		_, capture = catCapturePath(args[1:])
+	}
+	if strings.ContainsAny(cmdLine, "<>") && !capture {
+		parsed, err := parseRedirection(strings.TrimSuffix(cmdLine, "&"))
+		if err != nil {
+			setExitStatus(2)
+			fmt.Fprintln(writer, err)
+			endCommandOutput()
+			updatePrompt()
+			return
+		}
+		if parsed.stdin != "" || parsed.stdout != "" || parsed.stderr != "" || parsed.stderrToStdout {
+			redirect = &parsed
+			args = parsed.args
+		}
+	}
+	cmd := args[0]
+
+	// Check for aliases
+	args = expandAlias(args)
+	cmd = args[0]
+	if redirect != nil {
+		redirect.args = args
+	}
+
+	if builtinFunc, ok := builtins[cmd]; ok {
+		setExitStatus(0)
+		if strings.HasSuffix(cmdLine, "&") && shellStateBuiltins[cmd] {
+			setExitStatus(1)
+			fmt.Fprintf(writer, "dyshell: %s: cannot run in the background\n", cmd)
+		} else if strings.HasSuffix(cmdLine, "&") {
+			startBuiltinJob(strings.TrimSuffix(cmdLine, "&"), redirect, builtinFunc, writer)
+		} else if redirect != nil {
+			executeRedirectedBuiltin(*redirect, builtinFunc, writer)
+		} else if interruptibleBuiltins[cmd] {
+			job := runBuiltinJob(0, cmdLine, builtinFunc, args[1:], writer)
 			mu.Lock()
-			delete(aliases, alias)
+			foregroundJob = job
 			mu.Unlock()
+			go waitJob(job)
+		} else {
+			builtinFunc(args[1:], writer)
+		}
+	} else {
+		// Check for background job
+		if strings.HasSuffix(cmdLine, "&") {
+			cmdLine = strings.TrimSuffix(cmdLine, "&")
+			args, _ = tokenize(cmdLine)
+			if redirect != nil {
+				args = redirect.args
+			}
+			if len(args) == 0 {
+				fmt.Fprintln(writer, "syntax error near unexpected token '&'")
+				endCommandOutput()
+				updatePrompt()
+				return
+			}
+			cmd := newCommand(args[0], args[1:]...)
+			cmd.Stdout = writer
+			jobID := newJobID()
+			if logWriter := newJobLogWriter(jobID, cmdLine); logWriter != nil {
+				cmd.Stdout = io.MultiWriter(writer, logWriter)
+			}
+			cmd.Stderr = cmd.Stdout
+			files, opened := redirectedFiles{}, true
+			if redirect != nil {
+				files, opened = openRedirections(*redirect, writer)
+				files.redirect(cmd, redirect.stderrToStdout)
+			}
+			if opened {
+				setProcessGroup(cmd, 0)
+				if err := cmd.Start(); err == nil {
+					job := newJob(jobID, strings.TrimSpace(cmdLine), []*exec.Cmd{cmd}, processGroupOf(cmd))
+					mu.Lock()
+					lastBgPid = cmd.Process.Pid
+					mu.Unlock()
+					setExitStatus(0)
+					fmt.Fprintf(writer, "[%d] %d\n", addJob(job), cmd.Process.Pid)
+				} else {
+					setExitStatus(exitStatusOf(err))
+					fmt.Fprintf(writer, "%s: %v\n", cmd.Args[0], err)
+				}
+				// The process has its own copies of the files
+				files.close()
+			}
+		} else {
+			// Check for redirection
+			if redirect != nil {
+				executeRedirectedCommand(*redirect, writer)
+			} else {
+				// Search for the command in PATH and execute it
+				if fullPath, found := findCommandPath(cmd); found {
+					executeExternalCommand(cmdLine, fullPath, args[1:], writer)
+				} else if shellFallbackShell {
+					runInSystemShell(rawLine, writer)
+				} else {
+					setExitStatus(127)
+					fmt.Fprintf(writer, "%s: command not found\n", cmd)
+				}
+			}
 		}
 	}
+
+	// Foreground jobs keep running; finish the line once they are done
+	afterForeground(func() {
+		endCommandOutput()
+		// Display prompt again
+		updatePrompt()
+	})
 }
 
-func exportCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		for _, envVar := range args {
-			parts := strings.SplitN(envVar, "=", 2)
-			if len(parts) == 2 {
-				os.Setenv(parts[0], parts[1])
-				mu.Lock()
-				envVars[parts[0]] = parts[1]
-				mu.Unlock()
+// runningScript is set while a script runs without the interface.
+var runningScript bool
+
+// endCommandOutput ends the output of a command in the transcript with a
+// newline, which sets it apart from the next prompt. A script run without
+// the interface has no prompts, so its output is left as it is.
+func endCommandOutput() {
+	if !runningScript {
+		fmt.Fprintln(textView, "")
+	}
+}
+
+// displayWriter writes command output to the transcript, expanding tabs to
+// spaces up to the next multiple of the configured tab width so columns
+// line up. Lines longer than maxDisplayLineLength are cut short, as a single
+// huge line is expensive to wrap and render. It is only used for display;
+// redirected output is left alone.
+type displayWriter struct {
+	column     int
+	truncating bool
+}
+
+// maxDisplayLineLength is the longest line, in runes, shown in full.
+const maxDisplayLineLength = 10000
+
+func newDisplayWriter() *displayWriter {
+	return &displayWriter{}
+}
+
+func (d *displayWriter) Write(p []byte) (int, error) {
+	if (shellTabWidth <= 0 || bytes.IndexByte(p, '\t') == -1) && linesFit(p, d.column) {
+		if i := bytes.LastIndexByte(p, '\n'); i >= 0 {
+			d.column = utf8.RuneCount(p[i+1:])
+			d.truncating = false
+		} else {
+			d.column += utf8.RuneCount(p)
+		}
+		return textView.Write(p)
+	}
+	var b bytes.Buffer
+	for _, c := range p {
+		switch {
+		case c == '\n':
+			b.WriteByte(c)
+			d.column = 0
+			d.truncating = false
+		case c&0xC0 == 0x80:
+			// A UTF-8 continuation byte goes wherever its leading byte went
+			if !d.truncating {
+				b.WriteByte(c)
+			}
+		case d.column >= maxDisplayLineLength:
+			if !d.truncating {
+				b.WriteString(" … (line truncated)")
+				d.truncating = true
 			}
+		case c == '\t' && shellTabWidth > 0:
+			spaces := shellTabWidth - d.column%shellTabWidth
+			b.WriteString(strings.Repeat(" ", spaces))
+			d.column += spaces
+		default:
+			b.WriteByte(c)
+			d.column++
 		}
 	}
+	if _, err := textView.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
-func unsetCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		for _, envVar := range args {
-			os.Unsetenv(envVar)
-			mu.Lock()
-			delete(envVars, envVar)
-			mu.Unlock()
+// linesFit reports whether every line in p, the first one continuing at
+// column, is short enough to be shown in full. It counts bytes rather than
+// runes, so it may be too cautious but never lets a long line through.
+func linesFit(p []byte, column int) bool {
+	for {
+		i := bytes.IndexByte(p, '\n')
+		if i == -1 {
+			return column+len(p) <= maxDisplayLineLength
+		}
+		if column+i > maxDisplayLineLength {
+			return false
 		}
+		p = p[i+1:]
+		column = 0
+	}
+}
+
+// outputDrawInterval is the shortest time between redraws caused by output,
+// so that a command flooding the transcript cannot keep the UI busy
+// redrawing after every write.
+const outputDrawInterval = 30 * time.Millisecond
+
+// outputDrawPending is set while a redraw for new output is scheduled.
+var outputDrawPending bool
+
+// scheduleOutputDraw redraws the screen shortly after the transcript
+// changes. Changes made before the redraw happens are drawn with it.
+func scheduleOutputDraw() {
+	mu.Lock()
+	defer mu.Unlock()
+	if outputDrawPending {
+		return
+	}
+	outputDrawPending = true
+	time.AfterFunc(outputDrawInterval, func() {
+		mu.Lock()
+		outputDrawPending = false
+		mu.Unlock()
+		app.Draw()
+	})
+}
+
+// promptDrawInterval is how long the screen update after a key press is
+// held back, so that keys typed or repeated faster than that are shown
+// together.
+const promptDrawInterval = 15 * time.Millisecond
+
+// keyDrawDeferred is set while a key is handled, so the draw tview makes
+// afterwards is deferred. promptDrawPending is set while a deferred draw is
+// scheduled. Both are only used on the UI goroutine.
+var keyDrawDeferred, promptDrawPending bool
+
+// debouncedScreen holds back the screen updates of draws caused by keys.
+// Their content is still drawn into the screen's buffer, and it is shown by
+// the next draw, which is queued promptDrawInterval later unless another
+// draw comes first.
+type debouncedScreen struct {
+	tcell.Screen
+}
+
+func (s debouncedScreen) Show() {
+	if !keyDrawDeferred {
+		s.Screen.Show()
+		return
+	}
+	keyDrawDeferred = false
+	if promptDrawPending {
+		return
+	}
+	promptDrawPending = true
+	time.AfterFunc(promptDrawInterval, func() {
+		app.QueueUpdateDraw(func() {
+			promptDrawPending = false
+		})
+	})
+}
+
+// expandAlias replaces the command name in args with its alias, if it has
+// one. The alias may start with another alias, which is expanded in turn;
+// like in other shells a name is never expanded twice, so alias ls='ls -F'
+// works and alias loops end.
+func expandAlias(args []string) []string {
+	for _, step := range aliasChain(args[0]) {
+		args = append(aliasWords(step.value), args[1:]...)
+	}
+	return args
+}
+
+// aliasWords splits the value of an alias into words. A value with
+// unbalanced quotes is split at spaces.
+func aliasWords(value string) []string {
+	words, err := tokenize(value)
+	if err != nil {
+		return strings.Fields(value)
+	}
+	return words
+}
+
+// aliasStep is one alias expanded while resolving a command name.
+type aliasStep struct {
+	name, value string
+}
+
+// aliasChain returns the aliases expanded, in order, to resolve the command
+// name.
+func aliasChain(name string) []aliasStep {
+	var chain []aliasStep
+	seen := make(map[string]bool)
+	for !seen[name] {
+		seen[name] = true
+		value, ok := aliases[name]
+		words := aliasWords(value)
+		if !ok || len(words) == 0 {
+			break
+		}
+		chain = append(chain, aliasStep{name, value})
+		name = words[0]
+	}
+	return chain
+}
+
+func executeBuiltinCommand(cmd string, args []string, writer io.Writer) {
+	if builtinFunc, ok := builtins[cmd]; ok {
+		builtinFunc(args, writer)
+	} else {
+		fmt.Fprintf(writer, "%s: command not found\n", cmd)
+	}
+}
+
+func echoCommand(args []string, writer io.Writer) {
+	fmt.Fprintln(writer, strings.Join(args, " "))
+}
+
+// exitWarnedAt is the length of the history when exit last refused to
+// leave because of running jobs, or -1.
+var exitWarnedAt = -1
+
+// exitCommand leaves the shell. While jobs are running it refuses once,
+// like bash; exiting again straight away, or with exit -f, leaves anyway.
+func exitCommand(args []string, writer io.Writer) {
+	force := len(args) > 0 && args[0] == "-f"
+	mu.Lock()
+	// A typed exit has been added to the history, Ctrl-D has not
+	consecutive := exitWarnedAt >= 0 && len(history)-exitWarnedAt <= 1
+	historyLength := len(history)
+	mu.Unlock()
+	if !force && !consecutive && runningJobCount() > 0 {
+		exitWarnedAt = historyLength
+		fmt.Fprintln(writer, "There are running jobs.")
+		setExitStatus(1)
+		return
+	}
+	shutdown()
+}
+
+// shutdown saves the session state, restores the terminal and exits.
+func shutdown() {
+	if shellKillJobsOnExit {
+		terminateJobs()
+	}
+	saveAliasesAndEnvVars(filepath.Join(userHomeDir(), ".my_shell_aliases"))
+	saveEnvVars(filepath.Join(userHomeDir(), ".my_shell_env"))
+	saveBookmarks(filepath.Join(userHomeDir(), ".my_shell_bookmarks"))
+	saveDirVisits(filepath.Join(userHomeDir(), ".my_shell_z"))
+	saveMotd(filepath.Join(userHomeDir(), ".my_shell_motd"))
+	saveHistory(historyFilePath())
+	if app != nil {
+		app.Stop()
+	}
+	os.Exit(0)
+}
+
+// resetIdleTimer restarts the inactivity countdown. A zero timeout disables it.
+func resetIdleTimer() {
+	mu.Lock()
+	defer mu.Unlock()
+	if idleTimer != nil {
+		idleTimer.Stop()
+		idleTimer = nil
+	}
+	if shellIdleTimeout > 0 {
+		idleTimer = time.AfterFunc(shellIdleTimeout, func() {
+			app.QueueUpdate(shutdown)
+		})
+	}
+}
+
+// typeCommand tells how a command name would be run. An alias is followed
+// through every alias it expands to, down to the builtin or program that
+// finally runs.
+func typeCommand(args []string, writer io.Writer) {
+	if len(args) > 0 {
+		arg := args[0]
+		for _, step := range aliasChain(arg) {
+			fmt.Fprintf(writer, "%s is aliased to `%s'\n", step.name, step.value)
+			arg = aliasWords(step.value)[0]
+		}
+		if _, ok := builtins[arg]; ok {
+			fmt.Fprintf(writer, "%s is a shell builtin\n", arg)
+		} else if path, found := findCommandPath(arg); found {
+			fmt.Fprintf(writer, "%s is %s\n", arg, path)
+		} else {
+			fmt.Fprintf(writer, "%s not found\n", arg)
+		}
+	}
+}
+
+func pwdCommand(args []string, writer io.Writer) {
+	dir, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(writer, "Error: %v\n", err)
+	} else {
+		fmt.Fprintln(writer, dir)
+	}
+}
+
+func cdCommand(args []string, writer io.Writer) {
+	if len(args) > 0 {
+		dir := args[0]
+		if dir == "~" {
+			dir = userHomeDir()
+		}
+		if name, ok := strings.CutPrefix(dir, "@"); ok {
+			mu.Lock()
+			target, found := bookmarks[name]
+			mu.Unlock()
+			if found {
+				dir = target
+			}
+		}
+		err := os.Chdir(dir)
+		if err != nil {
+			setExitStatus(1)
+			fmt.Fprintf(writer, "cd: %s: No such file or directory\n", dir)
+		} else {
+			recordDirVisit()
+		}
+		updatePrompt()
+	} else {
+		if os.Chdir(userHomeDir()) == nil {
+			recordDirVisit()
+		}
+		updatePrompt()
+	}
+}
+
+func whoamiCommand(args []string, writer io.Writer) {
+	user, err := user.Current()
+	if err != nil {
+		fmt.Fprintf(writer, "Error: %v\n", err)
+	} else {
+		fmt.Fprintln(writer, user.Username)
+	}
+}
+
+func lsCommand(args []string, writer io.Writer) {
+	path := "."
+	sortBy := 'n'
+	reverse := false
+	human := false
+	classify := false
+	for _, arg := range args {
+		if len(arg) < 2 || arg[0] != '-' {
+			path = arg
+			continue
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't', 'S':
+				sortBy = flag
+			case 'r':
+				reverse = true
+			case 'h':
+				human = true
+			case 'F':
+				classify = true
+			case 'l':
+				// Listings are always in long format; accepted so that
+				// the familiar "ls -l" and "ls -lh" work.
+			default:
+				setExitStatus(2)
+				fmt.Fprintf(writer, "ls: invalid option -- '%c'\n", flag)
+				return
+			}
+		}
+	}
+	files, err := os.ReadDir(path)
+	if err != nil {
+		setExitStatus(2)
+		fmt.Fprintf(writer, "ls: cannot access '%s': %v\n", path, err)
+		return
+	}
+	infos := make([]os.FileInfo, 0, len(files))
+	for _, file := range files {
+		// Lstat so that symlinks are listed as links, not as their targets
+		info, err := os.Lstat(filepath.Join(path, file.Name()))
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		switch sortBy {
+		case 't':
+			return infos[i].ModTime().After(infos[j].ModTime())
+		case 'S':
+			return infos[i].Size() > infos[j].Size()
+		default:
+			return infos[i].Name() < infos[j].Name()
+		}
+	})
+	if reverse {
+		for i, j := 0, len(infos)-1; i < j; i, j = i+1, j-1 {
+			infos[i], infos[j] = infos[j], infos[i]
+		}
+	}
+	for _, info := range infos {
+		modTime := info.ModTime().Format("Jan 02 15:04")
+		size := strconv.FormatInt(info.Size(), 10)
+		if human {
+			size = humanSize(info.Size())
+		}
+		name := info.Name()
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Readlink(filepath.Join(path, name)); err == nil {
+				name += " -> " + target
+				// The indicator describes what the link points to
+				if classify {
+					if targetInfo, err := os.Stat(filepath.Join(path, info.Name())); err == nil {
+						name += classifyIndicator(targetInfo)
+					}
+				}
+			}
+		} else if classify {
+			name += classifyIndicator(info)
+		}
+		fmt.Fprintf(writer, "%-20s %10s %s\n", name, size, modTime)
+	}
+}
+
+// classifyIndicator returns the suffix ls -F adds to a name: a slash for
+// directories and a star for executables.
+func classifyIndicator(info os.FileInfo) string {
+	switch {
+	case info.IsDir():
+		return "/"
+	case info.Mode().IsRegular() && info.Mode()&0111 != 0:
+		return "*"
+	}
+	return ""
+}
+
+// humanSize formats a byte count using powers of 1024, e.g. 1.2K or 3.4M.
+func humanSize(n int64) string {
+	if n < 1024 {
+		return strconv.FormatInt(n, 10)
+	}
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len("KMGTPE") {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%c", size, "KMGTPE"[unit-1])
+}
+
+func catCommand(args []string, writer io.Writer) {
+	if path, ok := catCapturePath(args); ok && !inPipeline(writer) {
+		captureToFile(path, writer)
+		return
+	}
+	if len(args) > 0 {
+		// A failed write means the rest of a pipeline has stopped reading,
+		// as with "cat big | head", so cat stops quietly like one killed by
+		// SIGPIPE
+		output := &recordingWriter{Writer: writer}
+		for _, file := range args {
+			if err := catFile(file, output); err != nil {
+				if output.err != nil {
+					return
+				}
+				setExitStatus(1)
+				fmt.Fprintf(writer, "cat: cannot read '%s': %v\n", file, err)
+			}
+		}
+	} else if stdin := builtinStdin(writer); stdin != nil {
+		io.Copy(writer, stdin)
+	} else {
+		setExitStatus(1)
+		fmt.Fprintln(writer, "cat: missing file operand")
+	}
+}
+
+// catFile streams the contents of path to writer, so that memory use stays
+// the same however large the file is.
+func catFile(path string, writer io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+// recordingWriter remembers the first error from writing to Writer, telling
+// write errors apart from read errors after an io.Copy.
+type recordingWriter struct {
+	io.Writer
+	err error
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// catCapturePath recognises the arguments of "cat > file" and returns the
+// file name.
+func catCapturePath(args []string) (string, bool) {
+	switch {
+	case len(args) == 2 && args[0] == ">" && args[1] != "":
+		return args[1], true
+	case len(args) == 1 && len(args[0]) > 1 && args[0][0] == '>' && args[0][1] != '>':
+		return args[0][1:], true
+	}
+	return "", false
+}
+
+// captureToFile collects the lines typed into the input line and writes
+// them to path once Ctrl-D is pressed, as "cat > path" does in a terminal.
+// Ctrl-C discards them.
+func captureToFile(path string, writer io.Writer) {
+	fmt.Fprintf(writer, "Enter the text for %s, then press Ctrl-D to save it or Ctrl-C to discard it.\n", path)
+	var text strings.Builder
+	startLineMode("", func(line string) {
+		text.WriteString(line + "\n")
+	}, func() {
+		stopLineMode()
+		if err := os.WriteFile(nullDevice(path), []byte(text.String()), 0644); err != nil {
+			setExitStatus(1)
+			fmt.Fprintf(textView, "cat: cannot write '%s': %v\n", path, err)
+		}
+	})
+}
+
+func touchCommand(args []string, writer io.Writer) {
+	if len(args) > 0 {
+		for _, file := range args {
+			f, err := os.Create(file)
+			if err != nil {
+				setExitStatus(1)
+				fmt.Fprintf(writer, "touch: cannot create '%s': %v\n", file, err)
+				continue
+			}
+			f.Close()
+		}
+	} else {
+		setExitStatus(1)
+		fmt.Fprintln(writer, "touch: missing file operand")
+	}
+}
+
+func rmCommand(args []string, writer io.Writer) {
+	if len(args) > 0 {
+		for _, file := range args {
+			err := os.Remove(file)
+			if err != nil {
+				setExitStatus(1)
+				fmt.Fprintf(writer, "rm: cannot remove '%s': %v\n", file, err)
+				continue
+			}
+		}
+	} else {
+		setExitStatus(1)
+		fmt.Fprintln(writer, "rm: missing file operand")
+	}
+}
+
+func mkdirCommand(args []string, writer io.Writer) {
+	if len(args) > 0 {
+		for _, dir := range args {
+			err := os.Mkdir(dir, 0755)
+			if err != nil {
+				setExitStatus(1)
+				fmt.Fprintf(writer, "mkdir: cannot create directory '%s': %v\n", dir, err)
+				continue
+			}
+		}
+	} else {
+		setExitStatus(1)
+		fmt.Fprintln(writer, "mkdir: missing directory operand")
+	}
+}
+
+func rmdirCommand(args []string, writer io.Writer) {
+	if len(args) > 0 {
+		for _, dir := range args {
+			err := os.Remove(dir)
+			if err != nil {
+				setExitStatus(1)
+				fmt.Fprintf(writer, "rmdir: cannot remove directory '%s': %v\n", dir, err)
+				continue
+			}
+		}
+	} else {
+		setExitStatus(1)
+		fmt.Fprintln(writer, "rmdir: missing directory operand")
+	}
+}
+
+func findCommand(args []string, writer io.Writer) {
+	root := "."
+	namePattern := ""
+	fileType := ""
+	maxDepth := -1
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			root = arg
+			continue
+		}
+		if i+1 >= len(args) {
+			fmt.Fprintf(writer, "find: missing argument to '%s'\n", arg)
+			setExitStatus(1)
+			return
+		}
+		i++
+		value := args[i]
+		switch arg {
+		case "-name":
+			if err := checkPattern(value); err != nil {
+				fmt.Fprintf(writer, "find: invalid pattern '%s': %v\n", value, err)
+				setExitStatus(1)
+				return
+			}
+			namePattern = value
+		case "-type":
+			if value != "f" && value != "d" {
+				fmt.Fprintf(writer, "find: unknown argument to -type: %s\n", value)
+				setExitStatus(1)
+				return
+			}
+			fileType = value
+		case "-maxdepth":
+			depth, err := strconv.Atoi(value)
+			if err != nil || depth < 0 {
+				fmt.Fprintf(writer, "find: invalid -maxdepth value '%s'\n", value)
+				setExitStatus(1)
+				return
+			}
+			maxDepth = depth
+		default:
+			fmt.Fprintf(writer, "find: unknown predicate '%s'\n", arg)
+			setExitStatus(1)
+			return
+		}
+	}
+
+	root = filepath.Clean(root)
+	ctx := builtinContext(writer)
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// Report the entry and keep walking the rest of the tree
+			fmt.Fprintf(writer, "find: '%s': %v\n", path, err)
+			setExitStatus(1)
+			return nil
+		}
+		depth := 0
+		if rel, err := filepath.Rel(root, path); err == nil && rel != "." {
+			depth = strings.Count(rel, string(filepath.Separator)) + 1
+		}
+		if maxDepth >= 0 && depth > maxDepth {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fileType == "f" && !d.Type().IsRegular() || fileType == "d" && !d.IsDir() {
+			return nil
+		}
+		if namePattern != "" {
+			if matched, _ := filepath.Match(namePattern, d.Name()); !matched {
+				return nil
+			}
+		}
+		fmt.Fprintln(writer, path)
+		return nil
+	})
+}
+
+func duCommand(args []string, writer io.Writer) {
+	human := false
+	summary := false
+	var roots []string
+	for _, arg := range args {
+		if len(arg) < 2 || arg[0] != '-' {
+			roots = append(roots, arg)
+			continue
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'h':
+				human = true
+			case 's':
+				summary = true
+			default:
+				fmt.Fprintf(writer, "du: invalid option -- '%c'\n", flag)
+				setExitStatus(1)
+				return
+			}
+		}
+	}
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+
+	printSize := func(size int64, path string) {
+		if human {
+			fmt.Fprintf(writer, "%s\t%s\n", humanSize(size), path)
+		} else {
+			fmt.Fprintf(writer, "%d\t%s\n", size, path)
+		}
+	}
+
+	ctx := builtinContext(writer)
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		sizes := make(map[string]int64)
+		var dirs []string
+		// WalkDir does not follow symlinks, so link loops cannot trap us
+		filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				fmt.Fprintf(writer, "du: cannot read '%s': %v\n", path, err)
+				setExitStatus(1)
+				return nil
+			}
+			if d.IsDir() {
+				dirs = append(dirs, path)
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			// Credit the file to every directory between it and the root
+			for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+				sizes[dir] += info.Size()
+				if dir == root || dir == filepath.Dir(dir) {
+					break
+				}
+			}
+			if path == root {
+				printSize(info.Size(), path)
+			}
+			return nil
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if len(dirs) == 0 {
+			continue
+		}
+		if summary {
+			printSize(sizes[root], root)
+			continue
+		}
+		// Subdirectories come after their parents in walk order, so
+		// walking backwards prints each directory after its contents.
+		for i := len(dirs) - 1; i >= 0; i-- {
+			printSize(sizes[dirs[i]], dirs[i])
+		}
+	}
+}
+
+// watchCommand reruns a command periodically and shows its latest output in
+// a pane to the right of the transcript. "watch -c" closes the pane again.
+func watchCommand(args []string, writer io.Writer) {
+	interval := 2 * time.Second
+	inPane := false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-c":
+			closeSidePane()
+			return
+		case "-p":
+			inPane = true
+		case "-n":
+			if len(args) < 2 {
+				fmt.Fprintln(writer, "watch: option requires an argument -- 'n'")
+				return
+			}
+			seconds, err := strconv.ParseFloat(args[1], 64)
+			if err != nil || seconds <= 0 {
+				fmt.Fprintf(writer, "watch: invalid interval '%s'\n", args[1])
+				return
+			}
+			interval = time.Duration(seconds * float64(time.Second))
+			args = args[1:]
+		default:
+			fmt.Fprintf(writer, "watch: invalid option '%s'\n", args[0])
+			return
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(writer, "Usage: watch -p [-n seconds] command | watch -c")
+		return
+	}
+	if !inPane {
+		fmt.Fprintln(writer, "watch: only pane mode is supported, use watch -p")
+		return
+	}
+	openSidePane(strings.Join(args, " "), args, interval)
+}
+
+// openSidePane splits the screen and keeps the right-hand pane filled with the
+// output of args, rerun every interval. Any previous watch is replaced.
+func openSidePane(title string, args []string, interval time.Duration) {
+	closeSidePane()
+	sidePane = tview.NewTextView().SetDynamicColors(false).SetWordWrap(true)
+	sidePane.SetBorder(true).SetTitle(title)
+	panes.AddItem(sidePane, 0, 1, false)
+
+	stop := make(chan struct{})
+	stopWatch = stop
+	pane := sidePane
+	refresh := func() {
+		output := new(strings.Builder)
+		if builtinFunc, ok := builtins[args[0]]; ok {
+			// Builtins touch shell state, so run them on the UI goroutine
+			done := make(chan struct{})
+			app.QueueUpdate(func() {
+				builtinFunc(args[1:], output)
+				close(done)
+			})
+			<-done
+		} else if path, found := findCommandPath(args[0]); found {
+			cmd := exec.Command(path, args[1:]...)
+			cmd.Stdout = output
+			cmd.Stderr = output
+			if err := cmd.Run(); err != nil {
+				fmt.Fprintf(output, "%s: %v\n", args[0], err)
+			}
+		} else {
+			fmt.Fprintf(output, "%s: command not found\n", args[0])
+		}
+		app.QueueUpdateDraw(func() {
+			pane.SetText(output.String())
+		})
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			refresh()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// closeSidePane stops the running watch and returns to the single view.
+func closeSidePane() {
+	if stopWatch != nil {
+		close(stopWatch)
+		stopWatch = nil
+	}
+	if sidePane != nil {
+		panes.RemoveItem(sidePane)
+		sidePane = nil
+	}
+}
+
+func mathCommand(args []string, writer io.Writer) {
+	if len(args) == 0 {
+		fmt.Fprintln(writer, "Usage: math <expression>")
+		return
+	}
+	if shellMathFloat {
+		value, err := evalFloat(strings.Join(args, " "))
+		if err != nil {
+			setExitStatus(1)
+			fmt.Fprintf(writer, "math: %v\n", err)
+			return
+		}
+		fmt.Fprintln(writer, formatFloat(value))
+		return
+	}
+	value, err := evalArithmetic(strings.Join(args, " "))
+	if err != nil {
+		setExitStatus(1)
+		fmt.Fprintf(writer, "math: %v\n", err)
+		return
+	}
+	fmt.Fprintln(writer, value)
+}
+
+// bcCommand evaluates a floating-point expression or, without arguments,
+// turns the input line into a calculator until "quit" is entered.
+func bcCommand(args []string, writer io.Writer) {
+	calculate := func(expr string, writer io.Writer) {
+		value, err := evalFloat(expr)
+		if err != nil {
+			setExitStatus(1)
+			fmt.Fprintf(writer, "bc: %v\n", err)
+			return
+		}
+		fmt.Fprintln(writer, formatFloat(value))
+	}
+	if len(args) > 0 {
+		calculate(strings.Join(args, " "), writer)
+		return
+	}
+	fmt.Fprintln(writer, "Enter expressions to evaluate, or quit to return to the shell.")
+	startLineMode("bc> ", func(line string) {
+		if line == "quit" {
+			stopLineMode()
+			return
+		}
+		if line != "" {
+			calculate(line, textView)
+		}
+	}, nil)
+}
+
+// historyCommand lists this session's history. --grep keeps the entries
+// matching a regular expression and --since those run within a duration.
+func historyCommand(args []string, writer io.Writer) {
+	var pattern *regexp.Regexp
+	var since time.Time
+	limit := -1
+	for i := 0; i < len(args); i++ {
+		if n, err := strconv.Atoi(args[i]); err == nil && n >= 0 {
+			limit = n
+			continue
+		}
+		switch args[i] {
+		case "-c":
+			clearHistory(writer)
+			return
+		case "--grep", "--since":
+			if i+1 >= len(args) {
+				fmt.Fprintf(writer, "history: %s requires an argument\n", args[i])
+				setExitStatus(1)
+				return
+			}
+			if args[i] == "--grep" {
+				re, err := regexp.Compile(args[i+1])
+				if err != nil {
+					fmt.Fprintf(writer, "history: invalid pattern: %v\n", err)
+					setExitStatus(1)
+					return
+				}
+				pattern = re
+			} else {
+				duration, err := parseDuration(args[i+1])
+				if err != nil {
+					fmt.Fprintf(writer, "history: invalid duration '%s'\n", args[i+1])
+					setExitStatus(1)
+					return
+				}
+				since = time.Now().Add(-duration)
+			}
+			i++
+		default:
+			fmt.Fprintln(writer, "Usage: history [-c] [N] [--grep <pattern>] [--since <duration>]")
+			setExitStatus(1)
+			return
+		}
+	}
+
+	mu.Lock()
+	var lines []string
+	for i, cmd := range history {
+		if pattern != nil && !pattern.MatchString(cmd) {
+			continue
+		}
+		if !since.IsZero() && historyTimes[i].Before(since) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%d %s\n", i+1, cmd))
+	}
+	mu.Unlock()
+	// history N shows only the last N of the entries
+	if limit >= 0 && limit < len(lines) {
+		lines = lines[len(lines)-limit:]
+	}
+	for _, line := range lines {
+		fmt.Fprint(writer, line)
+	}
+}
+
+// clearHistory forgets every history entry, including those saved by
+// earlier sessions.
+func clearHistory(writer io.Writer) {
+	mu.Lock()
+	history = nil
+	historyTimes = nil
+	mu.Unlock()
+	exitWarnedAt = -1
+	if err := os.Truncate(historyFilePath(), 0); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(writer, "history: %v\n", err)
+		setExitStatus(1)
+	}
+}
+
+// fcListLength is how many entries fc -l lists, as in bash.
+const fcListLength = 16
+
+// fcCommand recalls a history entry into the input line for editing before
+// it is run again: the previous command, or entry n, counted from the end
+// when negative. fc -l lists the latest entries instead.
+func fcCommand(args []string, writer io.Writer) {
+	mu.Lock()
+	entries := history
+	// Leave out the fc command itself
+	if n := len(entries); n > 0 && (entries[n-1] == "fc" || strings.HasPrefix(entries[n-1], "fc ")) {
+		entries = entries[:n-1]
+	}
+	entries = entries[:len(entries):len(entries)]
+	mu.Unlock()
+
+	if len(args) > 0 && args[0] == "-l" {
+		start := max(len(entries)-fcListLength, 0)
+		for i := start; i < len(entries); i++ {
+			fmt.Fprintf(writer, "%d %s\n", i+1, entries[i])
+		}
+		return
+	}
+	if len(args) > 1 {
+		fmt.Fprintln(writer, "Usage: fc [-l] [n]")
+		setExitStatus(2)
+		return
+	}
+
+	index := len(entries) - 1
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintln(writer, "Usage: fc [-l] [n]")
+			setExitStatus(2)
+			return
+		}
+		if n < 0 {
+			index = len(entries) + n
+		} else {
+			index = n - 1
+		}
+	}
+	if index < 0 || index >= len(entries) {
+		fmt.Fprintln(writer, "fc: history specification out of range")
+		setExitStatus(1)
+		return
+	}
+	setInput(entries[index])
+}
+
+func historySearchCommand(args []string, writer io.Writer) {
+	if len(args) == 0 {
+		fmt.Fprintln(writer, "Usage: history-search <term>")
+		return
+	}
+	matches := searchHistory(strings.Join(args, " "))
+	if len(matches) == 0 {
+		setExitStatus(1)
+	}
+	for _, match := range matches {
+		fmt.Fprintln(writer, match)
+	}
+}
+
+// searchHistory returns the distinct history entries containing term,
+// newest first. The history file from earlier sessions is searched too when
+// this session has no match or history-search-all is set.
+func searchHistory(term string) []string {
+	var matches []string
+	seen := make(map[string]bool)
+	collect := func(entries []string) {
+		for i := len(entries) - 1; i >= 0; i-- {
+			entry := entries[i]
+			if strings.Contains(entry, term) && !seen[entry] {
+				seen[entry] = true
+				matches = append(matches, entry)
+			}
+		}
+	}
+
+	mu.Lock()
+	collect(history)
+	mu.Unlock()
+	if len(matches) == 0 || shellHistorySearchAll {
+		collect(readHistoryFile(historyFilePath()))
+	}
+	return matches
+}
+
+// historyFilePath returns where command history is kept between sessions.
+func historyFilePath() string {
+	return filepath.Join(userHomeDir(), ".my_shell_history")
+}
+
+// readHistoryFile returns the entries of a history file, oldest first.
+func readHistoryFile(path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries
+}
+
+// loadHistory starts the history with the entries saved by earlier
+// sessions. Their times are unknown, so history --since leaves them out.
+func loadHistory(path string) {
+	entries := readHistoryFile(path)
+	if len(entries) > shellHistorySize {
+		entries = entries[len(entries)-shellHistorySize:]
+	}
+	mu.Lock()
+	history = append(entries, history...)
+	historyTimes = append(make([]time.Time, len(entries)), historyTimes...)
+	mu.Unlock()
+}
+
+// saveHistory writes the last history-size entries to path. Entries
+// spanning several lines are left out, since the file has one per line.
+func saveHistory(path string) {
+	mu.Lock()
+	var entries []string
+	for _, entry := range history {
+		if entry != "" && !strings.Contains(entry, "\n") {
+			entries = append(entries, entry)
+		}
+	}
+	mu.Unlock()
+	if len(entries) > shellHistorySize {
+		entries = entries[len(entries)-shellHistorySize:]
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		fmt.Printf("Error saving history: %v\n", err)
+		return
+	}
+	defer file.Close()
+	for _, entry := range entries {
+		fmt.Fprintln(file, entry)
+	}
+}
+
+func clearCommand(args []string, writer io.Writer) {
+	textView.Clear()
+}
+
+func aliasCommand(args []string, writer io.Writer) {
+	if len(args) == 0 {
+		mu.Lock()
+		for k, v := range aliases {
+			fmt.Fprintf(writer, "alias %s='%s'\n", k, v)
+		}
+		mu.Unlock()
+	} else {
+		for _, alias := range args {
+			parts := strings.SplitN(alias, "=", 2)
+			if len(parts) == 2 {
+				mu.Lock()
+				aliases[parts[0]] = strings.Trim(parts[1], "'\"")
+				mu.Unlock()
+			}
+		}
+	}
+}
+
+func unaliasCommand(args []string, writer io.Writer) {
+	if len(args) > 0 {
+		for _, alias := range args {
+			mu.Lock()
+			delete(aliases, alias)
+			mu.Unlock()
+		}
+	}
+}
+
+func exportCommand(args []string, writer io.Writer) {
+	if len(args) > 0 {
+		for _, envVar := range args {
+			parts := strings.SplitN(envVar, "=", 2)
+			if len(parts) == 1 {
+				// Exporting an existing shell variable moves it into the
+				// environment
+				mu.Lock()
+				if value, ok := shellVars[parts[0]]; ok {
+					parts = append(parts, value)
+					delete(shellVars, parts[0])
+				}
+				mu.Unlock()
+			}
+			if len(parts) == 2 {
+				if strings.Contains(envVar, "=") && isReadonly(parts[0]) {
+					fmt.Fprintf(writer, "export: %s: readonly variable\n", parts[0])
+					setExitStatus(1)
+					continue
+				}
+				os.Setenv(parts[0], parts[1])
+				mu.Lock()
+				envVars[parts[0]] = parts[1]
+				mu.Unlock()
+			}
+		}
+	}
+}
+
+// readonlyCommand marks variables readonly, assigning them first when given
+// as NAME=value. Without arguments, or with -p, it lists readonly variables.
+func readonlyCommand(args []string, writer io.Writer) {
+	var names []string
+	for _, arg := range args {
+		if arg != "-p" {
+			names = append(names, arg)
+		}
+	}
+	if len(names) == 0 {
+		for _, name := range variableNames() {
+			if isReadonly(name) {
+				printDeclaration(name, writer)
+			}
+		}
+		return
+	}
+	declareCommand(append([]string{"-r"}, names...), writer)
+}
+
+// isReadonly reports whether the variable name may not be changed.
+func isReadonly(name string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return readonlyVars[name]
+}
+
+// localCommand would declare function-scoped variables, but dyshell does not
+// support shell functions, so like bash outside a function it always fails.
+func localCommand(args []string, writer io.Writer) {
+	fmt.Fprintln(writer, "local: can only be used in a function")
+	setExitStatus(1)
+}
+
+// declareCommand sets variables and their attributes: -i (integer), -x
+// (export) and -r (readonly). With -p, or no arguments at all, it prints the
+// named variables, or every variable, as declare commands.
+func declareCommand(args []string, writer io.Writer) {
+	var integer, export, readonly, print bool
+	var names []string
+	for _, arg := range args {
+		if len(arg) < 2 || arg[0] != '-' {
+			names = append(names, arg)
+			continue
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'i':
+				integer = true
+			case 'x':
+				export = true
+			case 'r':
+				readonly = true
+			case 'p':
+				print = true
+			default:
+				fmt.Fprintf(writer, "declare: -%c: invalid option\n", flag)
+				fmt.Fprintln(writer, "Usage: declare [-irxp] [name[=value] ...]")
+				setExitStatus(2)
+				return
+			}
+		}
+	}
+
+	if len(names) == 0 && (print || !(integer || export || readonly)) {
+		for _, name := range variableNames() {
+			printDeclaration(name, writer)
+		}
+		return
+	}
+	for _, arg := range names {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !isValidVariableName(name) {
+			fmt.Fprintf(writer, "declare: '%s': not a valid identifier\n", arg)
+			setExitStatus(1)
+			continue
+		}
+		if print {
+			if _, ok := lookupVariable(name); !ok {
+				fmt.Fprintf(writer, "declare: %s: not found\n", name)
+				setExitStatus(1)
+				continue
+			}
+			printDeclaration(name, writer)
+			continue
+		}
+
+		if isReadonly(name) && (hasValue || integer) {
+			fmt.Fprintf(writer, "declare: %s: readonly variable\n", name)
+			setExitStatus(1)
+			continue
+		}
+		if integer {
+			mu.Lock()
+			integerVars[name] = true
+			mu.Unlock()
+		}
+		if !hasValue {
+			// Declaring a variable gives it a value, if only an empty one
+			if _, ok := lookupVariable(name); !ok {
+				hasValue = true
+			}
+		}
+		if hasValue {
+			if err := setVariable(name, value); err != nil {
+				fmt.Fprintf(writer, "declare: %v\n", err)
+				setExitStatus(1)
+				continue
+			}
+		}
+		if export {
+			exportCommand([]string{name}, writer)
+		}
+		if readonly {
+			mu.Lock()
+			readonlyVars[name] = true
+			mu.Unlock()
+		}
+	}
+}
+
+// lookupVariable returns the value of a shell or environment variable and
+// whether it is set.
+func lookupVariable(name string) (string, bool) {
+	mu.Lock()
+	value, ok := shellVars[name]
+	mu.Unlock()
+	if ok {
+		return value, true
+	}
+	return os.LookupEnv(name)
+}
+
+// variableNames returns the sorted names of all shell and environment
+// variables.
+func variableNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, entry := range os.Environ() {
+		if name, _, ok := strings.Cut(entry, "="); ok && name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	mu.Lock()
+	for name := range shellVars {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	mu.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+// printDeclaration prints a variable as the declare command recreating it.
+func printDeclaration(name string, writer io.Writer) {
+	value, _ := lookupVariable(name)
+	mu.Lock()
+	flags := ""
+	if integerVars[name] {
+		flags += "i"
+	}
+	if readonlyVars[name] {
+		flags += "r"
+	}
+	if _, ok := shellVars[name]; !ok {
+		flags += "x"
+	}
+	mu.Unlock()
+	if flags == "" {
+		flags = "-"
+	}
+	fmt.Fprintf(writer, "declare -%s %s=%s\n", flags, name, strconv.Quote(value))
+}
+
+func unsetCommand(args []string, writer io.Writer) {
+	if len(args) > 0 {
+		for _, envVar := range args {
+			if isReadonly(envVar) {
+				fmt.Fprintf(writer, "unset: %s: cannot unset: readonly variable\n", envVar)
+				setExitStatus(1)
+				continue
+			}
+			os.Unsetenv(envVar)
+			mu.Lock()
+			delete(envVars, envVar)
+			delete(shellVars, envVar)
+			mu.Unlock()
+		}
+	}
+}
+
+// Job is a command or pipeline started by the shell. All of its processes
+// share a process group (where supported) so they are signalled together.
+type Job struct {
+	ID      int
+	Cmds    []*exec.Cmd
+	Line    string
+	Pgid    int
+	Stopped bool
+	started time.Time
+	done    chan struct{}
+	// builtins tracks the builtin stages of a pipeline, which run in the
+	// shell itself rather than as processes.
+	builtins *sync.WaitGroup
+	// cancel stops the builtins of a job that has no processes, like a
+	// builtin run in the background.
+	cancel context.CancelFunc
+	// lastCmd is the final stage of a pipeline when it is an external
+	// command. Its exit status becomes the shell's.
+	lastCmd *exec.Cmd
+	// timedOut is set when the timeout builtin stopped the job, whose exit
+	// status is then 124.
+	timedOut atomic.Bool
+}
+
+// errBuiltinJobStop is returned when suspending a job that runs inside the
+// shell, which cannot be stopped like a process.
+var errBuiltinJobStop = errors.New("builtin jobs cannot be stopped")
+
+// newJob creates a job for already started commands and waits for them in
+// the background.
+func newJob(id int, line string, cmds []*exec.Cmd, pgid int) *Job {
+	job := &Job{ID: id, Cmds: cmds, Line: line, Pgid: pgid, started: time.Now(), done: make(chan struct{})}
+	go waitJob(job)
+	return job
+}
+
+func waitJob(job *Job) {
+	var lastErr error
+	for _, cmd := range job.Cmds {
+		if err := cmd.Wait(); cmd == job.lastCmd {
+			lastErr = err
+		}
+	}
+	if job.builtins != nil {
+		job.builtins.Wait()
+	}
+	job.cancelBuiltins()
+	mu.Lock()
+	if job.timedOut.Load() {
+		setExitStatus(124)
+	} else if job.lastCmd != nil {
+		setExitStatus(exitStatusOf(lastErr))
+	}
+	wasForeground := foregroundJob == job
+	if wasForeground {
+		foregroundJob = nil
+	}
+	inBackground := false
+	if !wasForeground {
+		for _, j := range jobs {
+			if j == job {
+				inBackground = true
+			}
+		}
+	}
+	mu.Unlock()
+	if wasForeground {
+		setLastDuration(time.Since(job.started))
+	}
+	close(job.done)
+	if inBackground {
+		notifyJobDone(job)
+	}
+	if app != nil {
+		app.QueueUpdateDraw(func() {
+			runPendingCommands()
+			updatePrompt()
+		})
+	}
+}
+
+// interruptibleBuiltins can run long enough to want Ctrl-C. They run as
+// the foreground job, off the UI goroutine, and stop once their
+// builtinContext is done.
+var interruptibleBuiltins = map[string]bool{"find": true, "du": true, "grep": true, "wc": true, "head": true, "tail": true, "yes": true}
+
+// shellStateBuiltins change the state of the shell itself, such as its
+// working directory, variables or job table. A background job would do that
+// from another goroutine at an unknown time, so they cannot be run with &.
+var shellStateBuiltins = map[string]bool{
+	"exit": true, "cd": true, "history": true, "fc": true, "clear": true,
+	"alias": true, "unalias": true, "export": true, "unset": true,
+	"fg": true, "bg": true, "shell": true, "rehash": true, "dotenv": true,
+	"source": true, ".": true, "local": true, "declare": true,
+	"typeset": true, "readonly": true, "bookmark": true, "jump": true,
+	"z": true, "reload": true, "complete": true,
+}
+
+// startBuiltinJob runs a builtin as a background job. The job opens the
+// files of redirect, if any, itself.
+func startBuiltinJob(cmdLine string, redirect *redirection, builtinFunc func([]string, io.Writer), writer io.Writer) {
+	cmdLine = strings.TrimSpace(cmdLine)
+	args, err := tokenize(cmdLine)
+	if err != nil {
+		fmt.Fprintf(writer, "dyshell: %v\n", err)
+		setExitStatus(2)
+		return
+	}
+	args = expandAlias(args)
+	if redirect != nil {
+		redirected, run := *redirect, builtinFunc
+		args = redirected.args
+		builtinFunc = func(_ []string, output io.Writer) {
+			executeRedirectedBuiltin(redirected, run, output)
+		}
+	}
+	jobID := newJobID()
+	var output io.Writer = newDisplayWriter()
+	if logWriter := newJobLogWriter(jobID, cmdLine); logWriter != nil {
+		output = io.MultiWriter(output, logWriter)
+	}
+	job := runBuiltinJob(jobID, cmdLine, builtinFunc, args[1:], output)
+	fmt.Fprintf(writer, "[%d] %s\n", addJob(job), cmdLine)
+	go waitJob(job)
+}
+
+// runBuiltinJob runs a builtin in a goroutine of its own as a job without
+// processes. Cancelling the job cancels the builtin's builtinContext, and
+// from then on its output is dropped and every write fails. The caller
+// starts waitJob once the job is in the job table or in the foreground.
+func runBuiltinJob(id int, line string, builtinFunc func([]string, io.Writer), args []string, output io.Writer) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	var running sync.WaitGroup
+	running.Add(1)
+	job := &Job{ID: id, Line: line, builtins: &running, cancel: cancel, started: time.Now(), done: make(chan struct{})}
+	go func() {
+		defer running.Done()
+		builtinFunc(args, &builtinJobWriter{Writer: output, ctx: ctx})
+	}()
+	return job
+}
+
+// builtinJobWriter is the output of a builtin running as a job.
+type builtinJobWriter struct {
+	io.Writer
+	ctx context.Context
+}
+
+func (w *builtinJobWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.Writer.Write(p)
+}
+
+// cancelBuiltins stops the builtins of a job that runs inside the shell.
+func (job *Job) cancelBuiltins() {
+	if job.cancel != nil {
+		job.cancel()
+	}
+}
+
+// jobNotifyFlash is how long the border stays highlighted after a
+// background job finishes.
+const jobNotifyFlash = 500 * time.Millisecond
+
+// notifyJobDone announces a finished background job: it is reported in the
+// transcript, the terminal bell rings and the border flashes.
+func notifyJobDone(job *Job) {
+	if app == nil {
+		return
+	}
+	// The setting belongs to the UI goroutine, so it is checked there
+	app.QueueUpdateDraw(func() {
+		if !shellNotifyOnComplete {
+			return
+		}
+		os.Stdout.WriteString("\a")
+		fmt.Fprintf(textView, "\n[%d]+  Done    %s\n", job.ID, tview.Escape(job.Line))
+		shellView.SetBorderColor(tcell.ColorYellow)
+		time.AfterFunc(jobNotifyFlash, func() {
+			app.QueueUpdateDraw(func() {
+				shellView.SetBorderColor(tview.Styles.BorderColor)
+			})
+		})
+	})
+}
+
+// isDone reports whether every process in the job has exited.
+func (job *Job) isDone() bool {
+	select {
+	case <-job.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// lastExitStatus is the exit status of the most recent command. Jobs set it
+// from their own goroutines when they finish, so it is only accessed
+// through exitStatus and setExitStatus.
+var lastExitStatus atomic.Int32
+
+func exitStatus() int {
+	return int(lastExitStatus.Load())
+}
+
+func setExitStatus(status int) {
+	lastExitStatus.Store(int32(status))
+}
+
+// setLastDuration records how long the most recent command took.
+func setLastDuration(duration time.Duration) {
+	mu.Lock()
+	lastDuration = duration
+	mu.Unlock()
+}
+
+// runningJobCount returns the number of jobs that have not exited yet.
+func runningJobCount() int {
+	mu.Lock()
+	defer mu.Unlock()
+	count := 0
+	for _, job := range jobs {
+		if !job.isDone() {
+			count++
+		}
+	}
+	return count
+}
+
+// newJobID reserves a job number. Job numbers only ever increase, so a job
+// keeps its number however many of the jobs before it finish.
+func newJobID() int {
+	mu.Lock()
+	defer mu.Unlock()
+	lastJobID++
+	return lastJobID
+}
+
+// addJob adds job to the job table unless it is already there and returns
+// its job number, assigning one if the job has none yet.
+func addJob(job *Job) int {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, j := range jobs {
+		if j == job {
+			return job.ID
+		}
+	}
+	if job.ID == 0 {
+		lastJobID++
+		job.ID = lastJobID
+	}
+	jobs = append(jobs, job)
+	return job.ID
+}
+
+// interruptForegroundJob interrupts the running foreground job, as Ctrl-C
+// does in other shells. It reports false when there is no such job.
+func interruptForegroundJob() bool {
+	mu.Lock()
+	job := foregroundJob
+	mu.Unlock()
+	if job == nil || job.isDone() {
+		return false
+	}
+	if err := sendSignalInterrupt(job); err != nil {
+		fmt.Fprintf(textView, "Failed to interrupt job: %v\n", err)
+		return true
+	}
+	setExitStatus(130)
+	fmt.Fprintln(textView, "^C")
+	// Like other shells, abort the rest of the line or script as well
+	pendingCommands = nil
+	return true
+}
+
+// suspendForegroundJob stops the running foreground job, as Ctrl-Z does in
+// other shells, and moves it to the job table.
+func suspendForegroundJob() {
+	mu.Lock()
+	job := foregroundJob
+	foregroundJob = nil
+	mu.Unlock()
+	if job == nil {
+		return
+	}
+	if err := sendSignalStop(job); err != nil {
+		fmt.Fprintf(textView, "Failed to suspend job: %v\n", err)
+		return
+	}
+	mu.Lock()
+	job.Stopped = true
+	mu.Unlock()
+	fmt.Fprintf(textView, "\n[%d]+  Stopped    %s\n", addJob(job), job.Line)
+	runPendingCommands()
+}
+
+// pendingCommands holds the rest of a line or script while a foreground
+// job runs. It is only used from the UI goroutine.
+var pendingCommands []func()
+
+// afterForeground runs f once the foreground job, if any, has finished or
+// been stopped. Key events keep being handled in the meantime, so Ctrl-C
+// and Ctrl-Z still reach the job.
+func afterForeground(f func()) {
+	pendingCommands = append(pendingCommands, f)
+	runPendingCommands()
+}
+
+// runPendingCommands runs queued commands until one of them starts a
+// foreground job. Commands queued while running one go ahead of the
+// commands queued before it, so nested lines and scripts keep their order.
+func runPendingCommands() {
+	for len(pendingCommands) > 0 && !foregroundRunning() {
+		f, rest := pendingCommands[0], pendingCommands[1:]
+		pendingCommands = nil
+		f()
+		pendingCommands = append(pendingCommands, rest...)
+	}
+}
+
+// foregroundRunning reports whether a foreground job is still running.
+func foregroundRunning() bool {
+	mu.Lock()
+	job := foregroundJob
+	mu.Unlock()
+	return job != nil && !job.isDone()
+}
+
+// findJobByPid returns the job containing the process pid, if any.
+func findJobByPid(pid int) *Job {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, job := range jobs {
+		for _, cmd := range job.Cmds {
+			if cmd.Process.Pid == pid {
+				return job
+			}
+		}
+	}
+	return nil
+}
+
+// jobKillGracePeriod is how long jobs get to exit after SIGTERM before they
+// are killed outright.
+const jobKillGracePeriod = 2 * time.Second
+
+// terminateJobs asks every running job to exit, kills the ones still running
+// after jobKillGracePeriod and returns how many jobs were signalled.
+func terminateJobs() int {
+	mu.Lock()
+	var running []*Job
+	for _, job := range jobs {
+		if !job.isDone() {
+			running = append(running, job)
+		}
+	}
+	mu.Unlock()
+
+	for _, job := range running {
+		sendSignalTerm(job)
+		// A stopped job can only act on SIGTERM once it is resumed
+		sendSignalContinue(job)
+	}
+	deadline := time.Now().Add(jobKillGracePeriod)
+	for _, job := range running {
+		select {
+		case <-job.done:
+		case <-time.After(time.Until(deadline)):
+			sendSignalKill(job)
+		}
+	}
+	return len(running)
+}
+
+// timeoutCommand runs a command and stops it if it is still running after
+// the given duration, first with SIGTERM and then, after jobKillGracePeriod,
+// with SIGKILL. Like GNU timeout it exits with status 124 on timeout.
+func timeoutCommand(args []string, writer io.Writer) {
+	if len(args) < 2 {
+		fmt.Fprintln(writer, "Usage: timeout <duration> <command> [args...]")
+		setExitStatus(125)
+		return
+	}
+	duration, err := parseDuration(args[0])
+	if err != nil {
+		fmt.Fprintf(writer, "timeout: invalid time interval '%s'\n", args[0])
+		setExitStatus(125)
+		return
+	}
+	path, found := findCommandPath(args[1])
+	if !found {
+		fmt.Fprintf(writer, "timeout: %s: command not found\n", args[1])
+		setExitStatus(127)
+		return
+	}
+
+	cmd := exec.Command(path, args[2:]...)
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	setProcessGroup(cmd, 0)
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(writer, "timeout: %s: %v\n", args[1], err)
+		setExitStatus(exitStatusOf(err))
+		return
+	}
+	job := &Job{Cmds: []*exec.Cmd{cmd}, Line: strings.Join(args[1:], " "), Pgid: processGroupOf(cmd), lastCmd: cmd, started: time.Now(), done: make(chan struct{})}
+
+	// At the prompt the command becomes the foreground job like any other.
+	// In a pipeline or a background job the builtin has a goroutine of its
+	// own, which waits for the command there.
+	_, inJob := writer.(*builtinJobWriter)
+	foreground := !inJob && !inPipeline(writer)
+	if foreground {
+		mu.Lock()
+		foregroundJob = job
+		mu.Unlock()
+	}
+	go waitJob(job)
+	go enforceTimeout(job, duration)
+	if !foreground {
+		select {
+		case <-job.done:
+		case <-builtinContext(writer).Done():
+			sendSignalKill(job)
+			<-job.done
+		}
+	}
+}
+
+// enforceTimeout stops job once duration has passed, with SIGTERM and then
+// SIGKILL if it is still running after jobKillGracePeriod. waitJob then
+// gives it exit status 124.
+func enforceTimeout(job *Job, duration time.Duration) {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-job.done:
+		return
+	case <-timer.C:
+	}
+	job.timedOut.Store(true)
+	sendSignalTerm(job)
+	select {
+	case <-job.done:
+	case <-time.After(jobKillGracePeriod):
+		sendSignalKill(job)
+	}
+}
+
+// yesCommand repeatedly writes its arguments (or "y") until the reader at
+// the other end of the pipeline goes away or the job is interrupted.
+// Written to the transcript, a batch goes out once per redraw, which keeps
+// the transcript from outgrowing memory before Ctrl-C arrives.
+func yesCommand(args []string, writer io.Writer) {
+	line := "y"
+	if len(args) > 0 {
+		line = strings.Join(args, " ")
+	}
+	// Write in batches to avoid a system call per line
+	batch := []byte(strings.Repeat(line+"\n", 1+4096/(len(line)+1)))
+	ctx := builtinContext(writer)
+	paced := !inPipeline(writer)
+	for ctx.Err() == nil {
+		if _, err := writer.Write(batch); err != nil {
+			return
+		}
+		if paced {
+			select {
+			case <-ctx.Done():
+			case <-time.After(outputDrawInterval):
+			}
+		}
+	}
+}
+
+// grepCommand prints the lines of the given files, or of its piped input,
+// that match a regular expression. -i ignores case and -n puts the line
+// number in front of each match. Like grep it exits with status 1 when
+// nothing matched.
+func grepCommand(args []string, writer io.Writer) {
+	var ignoreCase, lineNumbers bool
+	var operands []string
+	for _, arg := range args {
+		if len(arg) < 2 || arg[0] != '-' || len(operands) > 0 {
+			operands = append(operands, arg)
+			continue
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'i':
+				ignoreCase = true
+			case 'n':
+				lineNumbers = true
+			default:
+				fmt.Fprintf(writer, "grep: invalid option -- '%c'\n", flag)
+				setExitStatus(2)
+				return
+			}
+		}
+	}
+	if len(operands) == 0 {
+		fmt.Fprintln(writer, "Usage: grep [-in] pattern [file...]")
+		setExitStatus(2)
+		return
+	}
+	pattern := operands[0]
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		fmt.Fprintf(writer, "grep: invalid pattern: %v\n", err)
+		setExitStatus(2)
+		return
+	}
+
+	ctx := builtinContext(writer)
+	paths := operands[1:]
+	matched := false
+	search := func(r io.Reader, name string) error {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for number := 1; scanner.Scan(); number++ {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			line := scanner.Text()
+			if !re.MatchString(line) {
+				continue
+			}
+			matched = true
+			// With several files every match says which one it is from
+			prefix := ""
+			if len(paths) > 1 {
+				prefix = name + ":"
+			}
+			if lineNumbers {
+				prefix += strconv.Itoa(number) + ":"
+			}
+			if _, err := fmt.Fprintln(writer, prefix+line); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	}
+
+	status := 0
+	if len(paths) == 0 {
+		stdin := builtinStdin(writer)
+		if stdin == nil {
+			fmt.Fprintln(writer, "Usage: grep [-in] pattern [file...]")
+			setExitStatus(2)
+			return
+		}
+		if err := search(stdin, ""); err != nil && ctx.Err() == nil {
+			fmt.Fprintf(writer, "grep: %v\n", err)
+			status = 2
+		}
+	}
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(writer, "grep: %s: %v\n", path, errors.Unwrap(err))
+			status = 2
+			continue
+		}
+		err = search(file, path)
+		file.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(writer, "grep: %s: %v\n", path, err)
+			status = 2
+		}
+	}
+	if status == 0 && !matched {
+		status = 1
+	}
+	setExitStatus(status)
+}
+
+// wcCounts holds what wc counts for one input.
+type wcCounts struct {
+	lines, words, bytes int
+}
+
+// wcCommand prints line, word and byte counts for the given files, or for
+// its piped input. Without flags all three are printed.
+func wcCommand(args []string, writer io.Writer) {
+	var showLines, showWords, showBytes bool
+	var paths []string
+	for _, arg := range args {
+		if len(arg) < 2 || arg[0] != '-' || len(paths) > 0 {
+			paths = append(paths, arg)
+			continue
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'l':
+				showLines = true
+			case 'w':
+				showWords = true
+			case 'c':
+				showBytes = true
+			default:
+				fmt.Fprintf(writer, "wc: invalid option -- '%c'\n", flag)
+				setExitStatus(1)
+				return
+			}
+		}
+	}
+	if !showLines && !showWords && !showBytes {
+		showLines, showWords, showBytes = true, true, true
+	}
+
+	ctx := builtinContext(writer)
+	count := func(r io.Reader) (wcCounts, error) {
+		var counts wcCounts
+		inWord := false
+		buf := make([]byte, 32*1024)
+		for {
+			if ctx.Err() != nil {
+				return counts, ctx.Err()
+			}
+			n, err := r.Read(buf)
+			counts.bytes += n
+			for _, b := range buf[:n] {
+				if b == '\n' {
+					counts.lines++
+				}
+				space := b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f'
+				if !space && !inWord {
+					counts.words++
+				}
+				inWord = !space
+			}
+			if err == io.EOF {
+				return counts, nil
+			}
+			if err != nil {
+				return counts, err
+			}
+		}
+	}
+
+	type result struct {
+		counts wcCounts
+		name   string
+	}
+	var results []result
+	var total wcCounts
+	if len(paths) == 0 {
+		stdin := builtinStdin(writer)
+		if stdin == nil {
+			fmt.Fprintln(writer, "Usage: wc [-lwc] [file...]")
+			setExitStatus(1)
+			return
+		}
+		counts, err := count(stdin)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(writer, "wc: %v\n", err)
+			setExitStatus(1)
+			return
+		}
+		results = append(results, result{counts, ""})
+		total = counts
+	}
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(writer, "wc: %s: %v\n", path, errors.Unwrap(err))
+			setExitStatus(1)
+			continue
+		}
+		counts, err := count(file)
+		file.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(writer, "wc: %s: %v\n", path, err)
+			setExitStatus(1)
+			continue
+		}
+		results = append(results, result{counts, path})
+		total.lines += counts.lines
+		total.words += counts.words
+		total.bytes += counts.bytes
+	}
+	if len(paths) > 1 {
+		results = append(results, result{total, "total"})
+	}
+
+	// Like coreutils, columns are as wide as the largest count, so a single
+	// count of piped input is printed on its own
+	largest := 0
+	if showLines {
+		largest = max(largest, total.lines)
+	}
+	if showWords {
+		largest = max(largest, total.words)
+	}
+	if showBytes {
+		largest = max(largest, total.bytes)
+	}
+	width := len(strconv.Itoa(largest))
+	for _, r := range results {
+		var fields []string
+		if showLines {
+			fields = append(fields, fmt.Sprintf("%*d", width, r.counts.lines))
+		}
+		if showWords {
+			fields = append(fields, fmt.Sprintf("%*d", width, r.counts.words))
+		}
+		if showBytes {
+			fields = append(fields, fmt.Sprintf("%*d", width, r.counts.bytes))
+		}
+		if r.name != "" {
+			fields = append(fields, r.name)
+		}
+		fmt.Fprintln(writer, strings.Join(fields, " "))
+	}
+}
+
+// headCommand prints the first lines of the given files, or of its piped
+// input, ten unless -n says otherwise.
+func headCommand(args []string, writer io.Writer) {
+	count, paths, ok := parseLineCount("head", args, writer)
+	if !ok {
+		return
+	}
+
+	ctx := builtinContext(writer)
+	head := func(r io.Reader) error {
+		reader := bufio.NewReader(r)
+		for printed := 0; printed < count; printed++ {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				if _, err := io.WriteString(writer, line); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(paths) == 0 {
+		stdin := builtinStdin(writer)
+		if stdin == nil {
+			fmt.Fprintln(writer, "Usage: head [-n count] [file...]")
+			setExitStatus(1)
+			return
+		}
+		if err := head(stdin); err != nil && ctx.Err() == nil {
+			fmt.Fprintf(writer, "head: %v\n", err)
+			setExitStatus(1)
+		}
+		return
+	}
+	for i, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(writer, "head: %s: %v\n", path, errors.Unwrap(err))
+			setExitStatus(1)
+			continue
+		}
+		// With several files each one gets a header, as in coreutils
+		if len(paths) > 1 {
+			if i > 0 {
+				fmt.Fprintln(writer)
+			}
+			fmt.Fprintf(writer, "==> %s <==\n", path)
+		}
+		err = head(file)
+		file.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(writer, "head: %s: %v\n", path, err)
+			setExitStatus(1)
+		}
+	}
+}
+
+// tailCommand prints the last lines of the given files, or of its piped
+// input, ten unless -n says otherwise. Only those lines are kept in memory,
+// however long the input is.
+func tailCommand(args []string, writer io.Writer) {
+	count, paths, ok := parseLineCount("tail", args, writer)
+	if !ok {
+		return
+	}
+
+	ctx := builtinContext(writer)
+	tail := func(r io.Reader) error {
+		// lines is a ring buffer of the last count lines, oldest at next
+		lines := make([]string, count)
+		next, seen := 0, 0
+		reader := bufio.NewReader(r)
+		for {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			line, err := reader.ReadString('\n')
+			if line != "" && count > 0 {
+				lines[next] = line
+				next = (next + 1) % count
+				seen++
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if seen < count {
+			lines, next = lines[:seen], 0
+		}
+		for i := range lines {
+			if _, err := io.WriteString(writer, lines[(next+i)%len(lines)]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(paths) == 0 {
+		stdin := builtinStdin(writer)
+		if stdin == nil {
+			fmt.Fprintln(writer, "Usage: tail [-n count] [file...]")
+			setExitStatus(1)
+			return
+		}
+		if err := tail(stdin); err != nil && ctx.Err() == nil {
+			fmt.Fprintf(writer, "tail: %v\n", err)
+			setExitStatus(1)
+		}
+		return
+	}
+	for i, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(writer, "tail: %s: %v\n", path, errors.Unwrap(err))
+			setExitStatus(1)
+			continue
+		}
+		if len(paths) > 1 {
+			if i > 0 {
+				fmt.Fprintln(writer)
+			}
+			fmt.Fprintf(writer, "==> %s <==\n", path)
+		}
+		err = tail(file)
+		file.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(writer, "tail: %s: %v\n", path, err)
+			setExitStatus(1)
+		}
+	}
+}
+
+// parseLineCount parses the arguments of head and tail: an optional -n N,
+// or -nN, followed by file names. The count defaults to ten.
+func parseLineCount(name string, args []string, writer io.Writer) (int, []string, bool) {
+	count := 10
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || arg[0] != '-' || len(paths) > 0 {
+			paths = append(paths, arg)
+			continue
+		}
+		value, ok := strings.CutPrefix(arg, "-n")
+		if !ok {
+			fmt.Fprintf(writer, "%s: invalid option -- '%s'\n", name, arg[1:])
+			setExitStatus(1)
+			return 0, nil, false
+		}
+		if value == "" {
+			if i+1 >= len(args) {
+				fmt.Fprintf(writer, "%s: option requires an argument -- 'n'\n", name)
+				setExitStatus(1)
+				return 0, nil, false
+			}
+			i++
+			value = args[i]
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			fmt.Fprintf(writer, "%s: invalid number of lines: '%s'\n", name, value)
+			setExitStatus(1)
+			return 0, nil, false
+		}
+		count = n
+	}
+	return count, paths, true
+}
+
+// sortCommand prints the lines of the given files, or of its piped input,
+// in sorted order.
+func sortCommand(args []string, writer io.Writer) {
+	var reverse, numeric, unique, foldCase bool
+	var paths []string
+	for _, arg := range args {
+		if len(arg) < 2 || arg[0] != '-' {
+			paths = append(paths, arg)
+			continue
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'r':
+				reverse = true
+			case 'n':
+				numeric = true
+			case 'u':
+				unique = true
+			case 'f':
+				foldCase = true
+			default:
+				fmt.Fprintf(writer, "sort: invalid option -- '%c'\n", flag)
+				setExitStatus(2)
+				return
+			}
+		}
+	}
+
+	var lines []string
+	readLines := func(r io.Reader) error {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		return scanner.Err()
+	}
+	if len(paths) == 0 {
+		stdin := builtinStdin(writer)
+		if stdin == nil {
+			fmt.Fprintln(writer, "Usage: sort [-rnuf] [file...]")
+			setExitStatus(2)
+			return
+		}
+		if err := readLines(stdin); err != nil {
+			fmt.Fprintf(writer, "sort: %v\n", err)
+			setExitStatus(2)
+			return
+		}
+	}
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(writer, "sort: cannot read: %s: %v\n", path, err)
+			setExitStatus(2)
+			return
+		}
+		err = readLines(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(writer, "sort: %s: %v\n", path, err)
+			setExitStatus(2)
+			return
+		}
+	}
+
+	key := func(line string) string {
+		if foldCase {
+			return strings.ToLower(line)
+		}
+		return line
+	}
+	// compare orders two lines by the selected keys, returning 0 only for
+	// lines that -u considers duplicates.
+	compare := func(a, b string) int {
+		if numeric {
+			x, y := leadingNumber(a), leadingNumber(b)
+			if x != y {
+				if x < y {
+					return -1
+				}
+				return 1
+			}
+		}
+		return strings.Compare(key(a), key(b))
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		if reverse {
+			return compare(lines[i], lines[j]) > 0
+		}
+		return compare(lines[i], lines[j]) < 0
+	})
+
+	for i, line := range lines {
+		if unique && i > 0 && compare(lines[i-1], line) == 0 {
+			continue
+		}
+		fmt.Fprintln(writer, line)
+	}
+}
+
+// leadingNumber parses the number at the start of line, ignoring leading
+// blanks, the way sort -n does. Lines without one count as zero.
+func leadingNumber(line string) float64 {
+	line = strings.TrimLeft(line, " \t")
+	end := 0
+	for end < len(line) && (line[end] >= '0' && line[end] <= '9' || line[end] == '.' || end == 0 && line[end] == '-') {
+		end++
+	}
+	for ; end > 0; end-- {
+		if value, err := strconv.ParseFloat(line[:end], 64); err == nil {
+			return value
+		}
+	}
+	return 0
+}
+
+// basenameCommand prints the last element of a path, optionally with a
+// suffix removed.
+func basenameCommand(args []string, writer io.Writer) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(writer, "Usage: basename <path> [suffix]")
+		setExitStatus(1)
+		return
+	}
+	name := filepath.Base(args[0])
+	// Like POSIX basename, never strip the whole name away
+	if len(args) == 2 && name != args[1] {
+		name = strings.TrimSuffix(name, args[1])
+	}
+	fmt.Fprintln(writer, name)
+}
+
+// dirnameCommand prints each path with its last element removed.
+func dirnameCommand(args []string, writer io.Writer) {
+	if len(args) == 0 {
+		fmt.Fprintln(writer, "Usage: dirname <path>...")
+		setExitStatus(1)
+		return
+	}
+	for _, path := range args {
+		// filepath.Dir treats "/a/b/" as naming a directory inside b, but
+		// dirname ignores trailing slashes
+		trimmed := strings.TrimRight(path, string(filepath.Separator)+"/")
+		if trimmed == "" && path != "" {
+			trimmed = path[:1]
+		}
+		fmt.Fprintln(writer, filepath.Dir(trimmed))
+	}
+}
+
+// realpathCommand prints the absolute, symlink-free form of each path. By
+// default every component but the last must exist; -e requires all of them
+// to and -m none.
+func realpathCommand(args []string, writer io.Writer) {
+	mode := 'f'
+	var paths []string
+	for _, arg := range args {
+		switch arg {
+		case "-e", "-f", "-m":
+			mode = rune(arg[1])
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(writer, "Usage: realpath [-e|-m] <path>...")
+		setExitStatus(1)
+		return
+	}
+	for _, path := range paths {
+		resolved, err := canonicalPath(path, mode)
+		if err != nil {
+			if pathErr, ok := err.(*os.PathError); ok {
+				err = pathErr.Err
+			}
+			fmt.Fprintf(writer, "realpath: %s: %v\n", path, err)
+			setExitStatus(1)
+			continue
+		}
+		fmt.Fprintln(writer, resolved)
+	}
+}
+
+// readlinkCommand prints the target of each symbolic link. With -f or -m it
+// prints the canonical path instead, like realpath and realpath -m.
+func readlinkCommand(args []string, writer io.Writer) {
+	mode := ' '
+	var paths []string
+	for _, arg := range args {
+		switch arg {
+		case "-e", "-f", "-m":
+			mode = rune(arg[1])
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(writer, "Usage: readlink [-e|-f|-m] <link>...")
+		setExitStatus(1)
+		return
+	}
+	for _, path := range paths {
+		var target string
+		var err error
+		if mode == ' ' {
+			target, err = os.Readlink(expandTilde(path))
+		} else {
+			target, err = canonicalPath(path, mode)
+		}
+		if err != nil {
+			if pathErr, ok := err.(*os.PathError); ok {
+				err = pathErr.Err
+			}
+			fmt.Fprintf(writer, "readlink: %s: %v\n", path, err)
+			setExitStatus(1)
+			continue
+		}
+		fmt.Fprintln(writer, target)
+	}
+}
+
+// lnCommand creates a hard link, or a symbolic link with -s, to target. With
+// -f an existing file at the link's name is removed first.
+func lnCommand(args []string, writer io.Writer) {
+	symbolic, force := false, false
+	var operands []string
+	for _, arg := range args {
+		if len(arg) < 2 || arg[0] != '-' {
+			operands = append(operands, arg)
+			continue
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 's':
+				symbolic = true
+			case 'f':
+				force = true
+			default:
+				fmt.Fprintf(writer, "ln: invalid option -- '%c'\n", flag)
+				setExitStatus(1)
+				return
+			}
+		}
+	}
+	if len(operands) == 0 || len(operands) > 2 {
+		fmt.Fprintln(writer, "Usage: ln [-s] [-f] <target> [link_name]")
+		setExitStatus(1)
+		return
+	}
+
+	target := operands[0]
+	linkName := filepath.Base(target)
+	if len(operands) == 2 {
+		linkName = operands[1]
+		if info, err := os.Stat(linkName); err == nil && info.IsDir() {
+			linkName = filepath.Join(linkName, filepath.Base(target))
+		}
+	}
+	if force {
+		if info, err := os.Lstat(linkName); err == nil && !info.IsDir() {
+			if err := os.Remove(linkName); err != nil {
+				fmt.Fprintf(writer, "ln: cannot remove '%s': %v\n", linkName, err)
+				setExitStatus(1)
+				return
+			}
+		}
+	}
+
+	var err error
+	if symbolic {
+		err = os.Symlink(target, linkName)
+	} else {
+		err = os.Link(target, linkName)
+	}
+	if err != nil {
+		if linkErr, ok := err.(*os.LinkError); ok {
+			err = linkErr.Err
+		}
+		if symbolic {
+			err = symlinkError(err)
+		}
+		fmt.Fprintf(writer, "ln: failed to create link '%s': %v\n", linkName, err)
+		setExitStatus(1)
+	}
+}
+
+// statCommand prints information about files without following symbolic
+// links. -c FORMAT prints just the requested fields, see statField.
+func statCommand(args []string, writer io.Writer) {
+	format := ""
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-c" {
+			if i+1 >= len(args) {
+				fmt.Fprintln(writer, "stat: option requires an argument -- 'c'")
+				setExitStatus(1)
+				return
+			}
+			format = args[i+1]
+			i++
+			continue
+		}
+		paths = append(paths, args[i])
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(writer, "Usage: stat [-c FORMAT] <file>...")
+		setExitStatus(1)
+		return
+	}
+
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			if pathErr, ok := err.(*os.PathError); ok {
+				err = pathErr.Err
+			}
+			fmt.Fprintf(writer, "stat: cannot stat '%s': %v\n", path, err)
+			setExitStatus(1)
+			continue
+		}
+		if format != "" {
+			var b strings.Builder
+			for i := 0; i < len(format); i++ {
+				if format[i] != '%' || i+1 == len(format) {
+					b.WriteByte(format[i])
+					continue
+				}
+				i++
+				b.WriteString(statField(path, info, format[i]))
+			}
+			fmt.Fprintln(writer, b.String())
+			continue
+		}
+
+		name := path
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Readlink(path); err == nil {
+				name += " -> " + target
+			}
+		}
+		fmt.Fprintf(writer, "  File: %s\n", name)
+		fmt.Fprintf(writer, "  Size: %-12d Type: %s\n", info.Size(), statField(path, info, 'F'))
+		fmt.Fprintf(writer, "Access: (%s/%s)", statField(path, info, 'a'), statField(path, info, 'A'))
+		if _, _, _, _, ok := fileOwner(info); ok {
+			fmt.Fprintf(writer, "  Uid: (%s/%s)  Gid: (%s/%s)\n", statField(path, info, 'u'), statField(path, info, 'U'), statField(path, info, 'g'), statField(path, info, 'G'))
+			fmt.Fprintf(writer, " Inode: %-12s Links: %s\n", statField(path, info, 'i'), statField(path, info, 'h'))
+		} else {
+			fmt.Fprintln(writer)
+		}
+		fmt.Fprintf(writer, "Modify: %s\n", statField(path, info, 'y'))
+	}
+}
+
+// statField expands a single stat -c format specifier:
+//
+//	%n name        %s size in bytes  %F file type
+//	%a octal mode  %A readable mode  %y modification time
+//	%Y modification time in seconds since the epoch
+//	%u owner ID    %U owner name     %g group ID    %G group name
+//	%i inode       %h hard links     %% a literal %
+//
+// Owner, group, inode and links are "?" where the platform lacks them.
+func statField(path string, info os.FileInfo, spec byte) string {
+	uid, gid, inode, links, ok := fileOwner(info)
+	switch spec {
+	case 'n':
+		return path
+	case 's':
+		return strconv.FormatInt(info.Size(), 10)
+	case 'F':
+		switch mode := info.Mode(); {
+		case mode.IsRegular():
+			return "regular file"
+		case mode.IsDir():
+			return "directory"
+		case mode&os.ModeSymlink != 0:
+			return "symbolic link"
+		case mode&os.ModeNamedPipe != 0:
+			return "fifo"
+		case mode&os.ModeSocket != 0:
+			return "socket"
+		case mode&os.ModeCharDevice != 0:
+			return "character special file"
+		case mode&os.ModeDevice != 0:
+			return "block special file"
+		}
+		return "unknown"
+	case 'a':
+		return fmt.Sprintf("%04o", info.Mode().Perm())
+	case 'A':
+		return info.Mode().String()
+	case 'y':
+		return info.ModTime().Format("2006-01-02 15:04:05.000000000 -0700")
+	case 'Y':
+		return strconv.FormatInt(info.ModTime().Unix(), 10)
+	case '%':
+		return "%"
+	}
+	if !ok {
+		switch spec {
+		case 'u', 'U', 'g', 'G', 'i', 'h':
+			return "?"
+		}
+		return "%" + string(spec)
+	}
+	switch spec {
+	case 'u':
+		return strconv.FormatUint(uid, 10)
+	case 'U':
+		if u, err := user.LookupId(strconv.FormatUint(uid, 10)); err == nil {
+			return u.Username
+		}
+		return "UNKNOWN"
+	case 'g':
+		return strconv.FormatUint(gid, 10)
+	case 'G':
+		if g, err := user.LookupGroupId(strconv.FormatUint(gid, 10)); err == nil {
+			return g.Name
+		}
+		return "UNKNOWN"
+	case 'i':
+		return strconv.FormatUint(inode, 10)
+	case 'h':
+		return strconv.FormatUint(links, 10)
+	}
+	return "%" + string(spec)
+}
+
+// chownCommand changes the owner and/or group of files, given as user,
+// :group or user:group. -R descends into directories without following
+// symbolic links.
+func chownCommand(args []string, writer io.Writer) {
+	if !chownSupported {
+		fmt.Fprintln(writer, "chown: not supported on this platform")
+		setExitStatus(1)
+		return
+	}
+	recursive := false
+	var operands []string
+	for _, arg := range args {
+		if arg == "-R" {
+			recursive = true
+			continue
+		}
+		operands = append(operands, arg)
+	}
+	if len(operands) < 2 {
+		fmt.Fprintln(writer, "Usage: chown [-R] <user>[:group] <file>...")
+		setExitStatus(1)
+		return
+	}
+	uid, gid, err := parseOwner(operands[0])
+	if err != nil {
+		fmt.Fprintf(writer, "chown: %v\n", err)
+		setExitStatus(1)
+		return
+	}
+
+	report := func(path string, err error) {
+		if pathErr, ok := err.(*os.PathError); ok {
+			err = pathErr.Err
+		}
+		if errors.Is(err, os.ErrPermission) {
+			fmt.Fprintf(writer, "chown: changing ownership of '%s': %v (changing ownership usually requires root)\n", path, err)
+		} else {
+			fmt.Fprintf(writer, "chown: changing ownership of '%s': %v\n", path, err)
+		}
+		setExitStatus(1)
+	}
+	for _, path := range operands[1:] {
+		if err := os.Chown(path, uid, gid); err != nil {
+			report(path, err)
+			continue
+		}
+		if !recursive {
+			continue
+		}
+		filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+			if err != nil {
+				report(p, err)
+				return nil
+			}
+			if p == path {
+				return nil
+			}
+			if err := os.Lchown(p, uid, gid); err != nil {
+				report(p, err)
+			}
+			return nil
+		})
+	}
+}
+
+// parseOwner resolves a chown owner spec of the form user, :group, user: or
+// user:group to numeric IDs. Names and IDs are both accepted; -1 leaves the
+// owner or group unchanged, and "user:" uses the user's login group.
+func parseOwner(spec string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	userName, groupName, hasGroup := strings.Cut(spec, ":")
+	if userName == "" && groupName == "" {
+		return 0, 0, fmt.Errorf("invalid spec: '%s'", spec)
+	}
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return 0, 0, fmt.Errorf("invalid user: '%s'", userName)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		if hasGroup && groupName == "" {
+			gid, _ = strconv.Atoi(u.Gid)
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("invalid group: '%s'", groupName)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// canonicalPath returns the absolute form of path with symlinks resolved.
+// mode says which components must exist: 'e' all of them, 'f' all but the
+// last, and 'm' none.
+func canonicalPath(path string, mode rune) (string, error) {
+	abs, err := filepath.Abs(expandTilde(path))
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err == nil || mode == 'e' || !os.IsNotExist(err) {
+		return resolved, err
+	}
+	if mode == 'f' {
+		dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, filepath.Base(abs)), nil
+	}
+	// Resolve the longest prefix that exists and keep the rest as it is
+	for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			rest, _ := filepath.Rel(dir, abs)
+			return filepath.Join(resolved, rest), nil
+		}
+		if dir == filepath.Dir(dir) {
+			return abs, nil
+		}
+	}
+}
+
+// expandTilde replaces a leading ~ in path with the user's home directory.
+func expandTilde(path string) string {
+	if path == "~" {
+		return userHomeDir()
+	}
+	if strings.HasPrefix(path, "~/") || strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		return filepath.Join(userHomeDir(), path[2:])
+	}
+	return path
+}
+
+// parseDuration parses a duration given as a number of seconds with
+// an optional s, m, h or d suffix, or in Go's duration syntax.
+func parseDuration(text string) (time.Duration, error) {
+	units := map[byte]time.Duration{'s': time.Second, 'm': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour}
+	number, unit := text, time.Second
+	if len(text) > 0 {
+		if u, ok := units[text[len(text)-1]]; ok {
+			number, unit = text[:len(text)-1], u
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		duration, err := time.ParseDuration(text)
+		if err != nil || duration < 0 {
+			return 0, errors.New("invalid duration")
+		}
+		return duration, nil
+	}
+	if value < 0 {
+		return 0, errors.New("invalid duration")
+	}
+	return time.Duration(value * float64(unit)), nil
+}
+
+func killallJobsCommand(args []string, writer io.Writer) {
+	fmt.Fprintf(writer, "Terminated %d job(s)\n", terminateJobs())
+}
+
+var (
+	bgLogFile *os.File
+	bgLogMu   sync.Mutex
+)
+
+// setBgLogfile switches the file that background job output is copied to.
+// An empty path turns logging off.
+func setBgLogfile(path string) error {
+	var file *os.File
+	if path != "" {
+		var err error
+		file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	bgLogMu.Lock()
+	if bgLogFile != nil {
+		bgLogFile.Close()
+	}
+	bgLogFile = file
+	bgLogMu.Unlock()
+	shellBgLogfile = path
+	return nil
+}
+
+// jobLogWriter copies a background job's output to the shared log file,
+// starting every line with the job number and command that produced it.
+type jobLogWriter struct {
+	prefix      string
+	atLineStart bool
+}
+
+// newJobLogWriter returns nil when background logging is off.
+func newJobLogWriter(jobNumber int, line string) *jobLogWriter {
+	bgLogMu.Lock()
+	defer bgLogMu.Unlock()
+	if bgLogFile == nil {
+		return nil
+	}
+	return &jobLogWriter{
+		prefix:      fmt.Sprintf("[%d] %s: ", jobNumber, strings.TrimSpace(line)),
+		atLineStart: true,
+	}
+}
+
+func (l *jobLogWriter) Write(p []byte) (int, error) {
+	bgLogMu.Lock()
+	defer bgLogMu.Unlock()
+	if bgLogFile == nil {
+		return len(p), nil
+	}
+	var b bytes.Buffer
+	for _, c := range p {
+		if l.atLineStart {
+			b.WriteString(l.prefix)
+		}
+		b.WriteByte(c)
+		l.atLineStart = c == '\n'
+	}
+	if _, err := bgLogFile.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// jobsCommand lists the job table in the jobs-format. -l lists the PID of
+// every process in a pipeline and -p only the PIDs. Finished jobs are
+// reported once and then removed from the table.
+func jobsCommand(args []string, writer io.Writer) {
+	long, pidsOnly := false, false
+	for _, arg := range args {
+		switch arg {
+		case "-l":
+			long = true
+		case "-p":
+			pidsOnly = true
+		default:
+			fmt.Fprintf(writer, "jobs: %s: invalid option\n", arg)
+			fmt.Fprintln(writer, "Usage: jobs [-l|-p]")
+			setExitStatus(2)
+			return
+		}
+	}
+
+	mu.Lock()
+	live := jobs[:0]
+	for _, job := range jobs {
+		state := "Running"
+		if job.isDone() {
+			state = "Done"
+		} else {
+			live = append(live, job)
+			if job.Stopped {
+				state = "Stopped"
+			}
+		}
+		// A builtin job runs inside the shell and has no PID of its own
+		pids := "-"
+		if len(job.Cmds) > 0 {
+			pids = strconv.Itoa(job.Cmds[0].Process.Pid)
+		}
+		if long && len(job.Cmds) > 0 {
+			pids = ""
+			for i, cmd := range job.Cmds {
+				if i > 0 {
+					pids += " "
+				}
+				pids += strconv.Itoa(cmd.Process.Pid)
+			}
+		}
+		if pidsOnly {
+			fmt.Fprintln(writer, pids)
+			continue
+		}
+		fmt.Fprintln(writer, formatJob(shellJobsFormat, job.ID, pids, state, job.Line))
+	}
+	// Clear the tail so removed jobs can be garbage collected
+	for i := len(live); i < len(jobs); i++ {
+		jobs[i] = nil
+	}
+	jobs = live
+	mu.Unlock()
+}
+
+// formatJob expands a jobs-format template: %n is the job number, %p the
+// process ID, %s the state, %c the command line and %% a literal %.
+func formatJob(format string, number int, pids, state, command string) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'n':
+			b.WriteString(strconv.Itoa(number))
+		case 'p':
+			b.WriteString(pids)
+		case 's':
+			b.WriteString(state)
+		case 'c':
+			b.WriteString(command)
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[i])
+		}
+	}
+	return b.String()
+}
+
+// psCommand lists the shell and the processes of its jobs. Where /proc is
+// available the scheduler state and CPU time come from the kernel.
+func psCommand(args []string, writer io.Writer) {
+	printProcess := func(pid int, state, command string) {
+		cpu := "-"
+		if procState, procCPU, ok := processStat(pid); ok {
+			state = procState
+			cpu = procCPU.Truncate(time.Second).String()
+		}
+		fmt.Fprintf(writer, "%7d %-8s %8s %s\n", pid, state, cpu, command)
+	}
+
+	fmt.Fprintf(writer, "%7s %-8s %8s %s\n", "PID", "STATE", "TIME", "CMD")
+	printProcess(os.Getpid(), "Running", "dyshell")
+	mu.Lock()
+	defer mu.Unlock()
+	for _, job := range jobs {
+		if job.isDone() {
+			continue
+		}
+		state := "Running"
+		if job.Stopped {
+			state = "Stopped"
+		}
+		for _, cmd := range job.Cmds {
+			printProcess(cmd.Process.Pid, state, strings.Join(cmd.Args, " "))
+		}
+	}
+}
+
+// findJob resolves a job spec to a job and its job number. Besides plain
+// job numbers it accepts %n, %+ (or %% and %) for the current job and %-
+// for the previous one.
+func findJob(spec string) (*Job, int) {
+	mu.Lock()
+	defer mu.Unlock()
+	var live []*Job
+	for _, job := range jobs {
+		if !job.isDone() {
+			live = append(live, job)
+		}
+	}
+	switch spec {
+	case "%", "%%", "%+":
+		if len(live) > 0 {
+			return live[len(live)-1], live[len(live)-1].ID
+		}
+	case "%-":
+		if len(live) > 1 {
+			return live[len(live)-2], live[len(live)-2].ID
+		}
+	default:
+		if jobNumber, err := strconv.Atoi(strings.TrimPrefix(spec, "%")); err == nil {
+			for _, job := range jobs {
+				if job.ID == jobNumber {
+					return job, job.ID
+				}
+			}
+		}
+	}
+	return nil, 0
+}
+
+func fgCommand(args []string, writer io.Writer) {
+	spec := "%+"
+	if len(args) > 0 {
+		spec = args[0]
+	}
+	job, _ := findJob(spec)
+	if job == nil {
+		fmt.Fprintf(writer, "fg: %s: no such job\n", spec)
+		return
+	}
+	mu.Lock()
+	stopped := job.Stopped
+	job.Stopped = false
+	mu.Unlock()
+	if stopped {
+		if err := sendSignalContinue(job); err != nil {
+			fmt.Fprintf(writer, "Failed to send continue signal: %v\n", err)
+			return
+		}
+	}
+	// The job keeps running while the prompt stays responsive, so
+	// Ctrl-Z can suspend it again.
+	if !job.isDone() {
+		mu.Lock()
+		foregroundJob = job
+		mu.Unlock()
+	}
+	fmt.Fprintln(writer, job.Line)
+}
+
+func bgCommand(args []string, writer io.Writer) {
+	spec := "%+"
+	if len(args) > 0 {
+		spec = args[0]
+	}
+	job, _ := findJob(spec)
+	if job == nil {
+		fmt.Fprintf(writer, "bg: %s: no such job\n", spec)
+		return
+	}
+	mu.Lock()
+	job.Stopped = false
+	mu.Unlock()
+	err := sendSignalContinue(job)
+	if err != nil {
+		fmt.Fprintf(writer, "Failed to send continue signal: %v\n", err)
+	}
+}
+
+// waitCommand blocks until the given jobs or PIDs, or every job, have exited.
+func waitCommand(args []string, writer io.Writer) {
+	var waitFor []*Job
+	if len(args) == 0 {
+		mu.Lock()
+		waitFor = append(waitFor, jobs...)
+		mu.Unlock()
+	}
+	for _, arg := range args {
+		var job *Job
+		if strings.HasPrefix(arg, "%") {
+			job, _ = findJob(arg)
+		} else if pid, err := strconv.Atoi(arg); err == nil {
+			job = findJobByPid(pid)
+		}
+		if job == nil {
+			fmt.Fprintf(writer, "wait: %s: no such job\n", arg)
+			continue
+		}
+		waitFor = append(waitFor, job)
+	}
+	for _, job := range waitFor {
+		<-job.done
+	}
+}
+
+func killCommand(args []string, writer io.Writer) {
+	if len(args) > 0 && strings.HasPrefix(args[0], "%") {
+		job, jobNumber := findJob(args[0])
+		if job == nil {
+			fmt.Fprintf(writer, "kill: %s: no such job\n", args[0])
+		} else if err := sendSignalKill(job); err == nil {
+			fmt.Fprintf(writer, "Job %d killed\n", jobNumber)
+		} else {
+			fmt.Fprintf(writer, "Failed to kill job %d: %v\n", jobNumber, err)
+		}
+		return
+	}
+	if len(args) > 0 {
+		pid, err := strconv.Atoi(args[0])
+		if job := findJobByPid(pid); err == nil && job != nil {
+			// Take down every process in the job, not just its leader
+			if err := sendSignalKill(job); err == nil {
+				fmt.Fprintf(writer, "Process %d killed\n", pid)
+			} else {
+				fmt.Fprintf(writer, "Failed to kill process %d: %v\n", pid, err)
+			}
+		} else if err == nil {
+			process, err := os.FindProcess(pid)
+			if err == nil {
+				err = process.Kill()
+				if err == nil {
+					fmt.Fprintf(writer, "Process %d killed\n", pid)
+				} else {
+					fmt.Fprintf(writer, "Failed to kill process %d: %v\n", pid, err)
+				}
+			} else {
+				fmt.Fprintf(writer, "Failed to find process %d: %v\n", pid, err)
+			}
+		} else {
+			fmt.Fprintf(writer, "Invalid PID: %s\n", args[0])
+		}
+	} else {
+		fmt.Fprintln(writer, "kill: missing PID operand")
+	}
+}
+
+func shellCustomizationCommand(args []string, writer io.Writer) {
+	if len(args) > 0 {
+		handleShellCustomization(args, writer)
+	} else {
+		printShellCustomization(writer)
+	}
+}
+
+func handleShellCustomization(args []string, writer io.Writer) {
+	if len(args) < 2 {
+		fmt.Fprintln(writer, "Usage: shell [option] [value]")
+		return
+	}
+
+	option := args[0]
+	value := strings.Join(args[1:], " ")
+
+	switch option {
+	case "expand":
+		// handleCommand has already run arithmetic, command substitution
+		// and variable expansion on the arguments, so only aliases remain
+		fmt.Fprintln(writer, strings.Join(expandAlias(args[1:]), " "))
+	case "reset":
+		if value == "all" {
+			for _, name := range shellOptions {
+				resetShellOption(name)
+			}
+			fmt.Fprintln(writer, "All options reset to their defaults")
+		} else if _, ok := shellDefaults[value]; ok {
+			resetShellOption(value)
+			fmt.Fprintf(writer, "%s reset to its default\n", value)
+		} else {
+			fmt.Fprintln(writer, "Unknown customization option.")
+		}
+	case "bg-opacity":
+		opacity, err := strconv.Atoi(value)
+		if err == nil && opacity >= 0 && opacity <= 100 {
+			shellBgOpacity = opacity
+			fmt.Fprintf(writer, "Background opacity set to %d%%\n", shellBgOpacity)
+		} else {
+			fmt.Fprintln(writer, "Invalid opacity value. Please enter a value between 0 and 100.")
+		}
+	case "text-size":
+		size, err := strconv.Atoi(value)
+		if err == nil && size > 0 {
+			shellTextSize = size
+			fmt.Fprintf(writer, "Text size set to %d\n", shellTextSize)
+		} else {
+			fmt.Fprintln(writer, "Invalid text size. Please enter a positive integer.")
+		}
+	case "text-color":
+		if isValidColor(value) {
+			shellTextColor = value
+			fmt.Fprintf(writer, "Text color set to %s\n", shellTextColor)
+		} else {
+			fmt.Fprintf(writer, "Invalid color '%s'. Use a color name (see 'shell text-color <Tab>') or #rrggbb.\n", value)
+		}
+	case "text-bold":
+		if value == "true" {
+			shellTextBold = true
+			fmt.Fprintln(writer, "Text bold set to true")
+		} else if value == "false" {
+			shellTextBold = false
+			fmt.Fprintln(writer, "Text bold set to false")
+		} else {
+			fmt.Fprintln(writer, "Invalid value for text-bold. Use true or false.")
+		}
+	case "motd":
+		shellMotd = value
+		fmt.Fprintf(writer, "Welcome message set to %s\n", shellMotd)
+	case "prompt-style":
+		shellPromptStyle = value
+		fmt.Fprintf(writer, "Prompt style set to %s\n", shellPromptStyle)
+	case "timeout":
+		seconds, err := strconv.Atoi(value)
+		if err == nil && seconds >= 0 {
+			shellIdleTimeout = time.Duration(seconds) * time.Second
+			resetIdleTimer()
+			fmt.Fprintf(writer, "Idle timeout set to %d seconds\n", seconds)
+		} else {
+			fmt.Fprintln(writer, "Invalid timeout. Please enter a number of seconds (0 disables it).")
+		}
+	case "cache-commands":
+		if value == "true" {
+			shellCacheCommands = true
+			fmt.Fprintln(writer, "Command caching set to true")
+		} else if value == "false" {
+			shellCacheCommands = false
+			clearCommandCache()
+			fmt.Fprintln(writer, "Command caching set to false")
+		} else {
+			fmt.Fprintln(writer, "Invalid value for cache-commands. Use true or false.")
+		}
+	case "kill-jobs-on-exit":
+		if value == "true" {
+			shellKillJobsOnExit = true
+			fmt.Fprintln(writer, "Kill jobs on exit set to true")
+		} else if value == "false" {
+			shellKillJobsOnExit = false
+			fmt.Fprintln(writer, "Kill jobs on exit set to false")
+		} else {
+			fmt.Fprintln(writer, "Invalid value for kill-jobs-on-exit. Use true or false.")
+		}
+	case "statusbar":
+		if value == "true" || value == "false" {
+			shellStatusBar = value == "true"
+			showStatusBar(shellStatusBar)
+			fmt.Fprintf(writer, "Status bar set to %s\n", value)
+		} else {
+			fmt.Fprintln(writer, "Invalid value for statusbar. Use true or false.")
+		}
+	case "tabwidth":
+		width, err := strconv.Atoi(value)
+		if err == nil && width >= 0 {
+			shellTabWidth = width
+			fmt.Fprintf(writer, "Tab width set to %d\n", shellTabWidth)
+		} else {
+			fmt.Fprintln(writer, "Invalid tab width. Please enter a non-negative integer (0 keeps tabs).")
+		}
+	case "bg-logfile":
+		if value == "off" {
+			value = ""
+		}
+		if err := setBgLogfile(value); err != nil {
+			fmt.Fprintf(writer, "Cannot open background log file: %v\n", err)
+		} else if value == "" {
+			fmt.Fprintln(writer, "Background job logging disabled")
+		} else {
+			fmt.Fprintf(writer, "Background job output logged to %s\n", value)
+		}
+	case "math-float":
+		if value == "true" || value == "false" {
+			shellMathFloat = value == "true"
+			fmt.Fprintf(writer, "Floating-point arithmetic set to %s\n", value)
+		} else {
+			fmt.Fprintln(writer, "Invalid value for math-float. Use true or false.")
+		}
+	case "long-cmd-threshold":
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err == nil && seconds >= 0 {
+			shellLongCmdThreshold = time.Duration(seconds * float64(time.Second))
+			fmt.Fprintf(writer, "Long command threshold set to %s\n", shellLongCmdThreshold)
+		} else {
+			fmt.Fprintln(writer, "Invalid threshold. Please enter a number of seconds.")
+		}
+	case "history-search-all":
+		if value == "true" || value == "false" {
+			shellHistorySearchAll = value == "true"
+			fmt.Fprintf(writer, "Search all history set to %s\n", value)
+		} else {
+			fmt.Fprintln(writer, "Invalid value for history-search-all. Use true or false.")
+		}
+	case "completion-menu":
+		if value == "true" || value == "false" {
+			shellCompletionMenu = value == "true"
+			fmt.Fprintf(writer, "Completion menu set to %s\n", value)
+		} else {
+			fmt.Fprintln(writer, "Invalid value for completion-menu. Use true or false.")
+		}
+	case "completion-case":
+		if value == "sensitive" || value == "insensitive" || value == "smart" {
+			shellCompletionCase = value
+			fmt.Fprintf(writer, "Completion case set to %s\n", value)
+		} else {
+			fmt.Fprintln(writer, "Invalid value for completion-case. Use sensitive, insensitive or smart.")
+		}
+	case "jobs-format":
+		shellJobsFormat = value
+		fmt.Fprintf(writer, "Jobs format set to %s\n", shellJobsFormat)
+	case "completion-key":
+		if key, ok := parseKeyName(value); ok {
+			shellCompletionKey = key
+			fmt.Fprintf(writer, "Completion key set to %s\n", tcell.KeyNames[key])
+		} else {
+			fmt.Fprintln(writer, "Invalid value for completion-key. Use a key name such as Tab, Ctrl-Space or F2.")
+		}
+	case "history-size":
+		size, err := strconv.Atoi(value)
+		if err == nil && size >= 0 {
+			shellHistorySize = size
+			fmt.Fprintf(writer, "History size set to %d\n", shellHistorySize)
+		} else {
+			fmt.Fprintln(writer, "Invalid history size. Please enter a non-negative integer.")
+		}
+	case "double-tab":
+		if value == "true" || value == "false" {
+			shellDoubleTab = value == "true"
+			fmt.Fprintf(writer, "Double tab set to %s\n", value)
+		} else {
+			fmt.Fprintln(writer, "Invalid value for double-tab. Use true or false.")
+		}
+	case "fallback-shell":
+		if value == "true" || value == "false" {
+			shellFallbackShell = value == "true"
+			fmt.Fprintf(writer, "Fallback shell set to %s\n", value)
+		} else {
+			fmt.Fprintln(writer, "Invalid value for fallback-shell. Use true or false.")
+		}
+	case "notify-on-complete":
+		if value == "true" || value == "false" {
+			shellNotifyOnComplete = value == "true"
+			fmt.Fprintf(writer, "Notify on complete set to %s\n", value)
+		} else {
+			fmt.Fprintln(writer, "Invalid value for notify-on-complete. Use true or false.")
+		}
+	default:
+		fmt.Fprintln(writer, "Unknown customization option.")
+	}
+}
+
+// isValidColor reports whether name is a tcell color name or a #rrggbb hex value.
+func isValidColor(name string) bool {
+	if _, ok := tcell.ColorNames[name]; ok {
+		return true
+	}
+	if len(name) != 7 || name[0] != '#' {
+		return false
+	}
+	_, err := strconv.ParseUint(name[1:], 16, 32)
+	return err == nil
+}
+
+// shellDefaults holds the default value of each customization option. It
+// is used at startup and by "shell reset".
+var shellDefaults = map[string]string{
+	"bg-opacity":         "100",
+	"text-size":          "12",
+	"text-color":         "white",
+	"text-bold":          "false",
+	"prompt-style":       "default",
+	"timeout":            "0",
+	"cache-commands":     "true",
+	"kill-jobs-on-exit":  "false",
+	"statusbar":          "true",
+	"tabwidth":           "8",
+	"bg-logfile":         "off",
+	"math-float":         "false",
+	"long-cmd-threshold": "3",
+	"history-search-all": "false",
+	"completion-menu":    "false",
+	"completion-case":    "sensitive",
+	"jobs-format":        "[%n]+  %p %s    %c",
+	"fallback-shell":     "false",
+	"motd":               "",
+	"notify-on-complete": "false",
+	"completion-key":     "Tab",
+	"double-tab":         "false",
+	"history-size":       "1000",
+}
+
+// resetShellOption sets option back to its default the same way "shell"
+// sets it, so whatever the option changes on screen is applied again.
+func resetShellOption(option string) {
+	handleShellCustomization([]string{option, shellDefaults[option]}, io.Discard)
+}
+
+func printShellCustomization(writer io.Writer) {
+	fmt.Fprintln(writer, "Shell Customization Options:")
+	fmt.Fprintf(writer, "bg-opacity: %d%%\n", shellBgOpacity)
+	fmt.Fprintf(writer, "text-size: %d\n", shellTextSize)
+	fmt.Fprintf(writer, "text-color: %s\n", shellTextColor)
+	fmt.Fprintf(writer, "text-bold: %t\n", shellTextBold)
+	fmt.Fprintf(writer, "prompt-style: %s\n", shellPromptStyle)
+	fmt.Fprintf(writer, "timeout: %d\n", int(shellIdleTimeout/time.Second))
+	fmt.Fprintf(writer, "cache-commands: %t\n", shellCacheCommands)
+	fmt.Fprintf(writer, "kill-jobs-on-exit: %t\n", shellKillJobsOnExit)
+	fmt.Fprintf(writer, "statusbar: %t\n", shellStatusBar)
+	fmt.Fprintf(writer, "tabwidth: %d\n", shellTabWidth)
+	fmt.Fprintf(writer, "bg-logfile: %s\n", shellBgLogfile)
+	fmt.Fprintf(writer, "math-float: %t\n", shellMathFloat)
+	fmt.Fprintf(writer, "long-cmd-threshold: %s\n", shellLongCmdThreshold)
+	fmt.Fprintf(writer, "history-search-all: %t\n", shellHistorySearchAll)
+	fmt.Fprintf(writer, "completion-menu: %t\n", shellCompletionMenu)
+	fmt.Fprintf(writer, "completion-case: %s\n", shellCompletionCase)
+	fmt.Fprintf(writer, "jobs-format: %s\n", shellJobsFormat)
+	fmt.Fprintf(writer, "fallback-shell: %t\n", shellFallbackShell)
+	fmt.Fprintf(writer, "motd: %s\n", shellMotd)
+	fmt.Fprintf(writer, "notify-on-complete: %t\n", shellNotifyOnComplete)
+	fmt.Fprintf(writer, "completion-key: %s\n", tcell.KeyNames[shellCompletionKey])
+	fmt.Fprintf(writer, "double-tab: %t\n", shellDoubleTab)
+	fmt.Fprintf(writer, "history-size: %d\n", shellHistorySize)
+}
+
+func executeExternalCommand(line, path string, args []string, writer io.Writer) {
+	cmd := exec.Command(path, args...)
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	startForegroundJob(cmd, line, writer)
+}
+
+// startForegroundJob starts cmd in a process group of its own as the
+// foreground job, which Ctrl-C and Ctrl-Z reach as they reach a pipeline.
+// waitJob sets the exit status once it has finished.
+func startForegroundJob(cmd *exec.Cmd, line string, writer io.Writer) {
+	setProcessGroup(cmd, 0)
+	if err := cmd.Start(); err != nil {
+		setExitStatus(exitStatusOf(err))
+		reportCommandError(writer, cmd.Args[0], err)
+		return
+	}
+	job := &Job{Cmds: []*exec.Cmd{cmd}, Line: line, Pgid: processGroupOf(cmd), lastCmd: cmd, started: time.Now(), done: make(chan struct{})}
+	mu.Lock()
+	foregroundJob = job
+	mu.Unlock()
+	go waitJob(job)
+}
+
+// reportCommandError explains why running the command name failed.
+func reportCommandError(writer io.Writer, name string, err error) {
+	if exitError, ok := err.(*exec.ExitError); ok {
+		fmt.Fprintf(writer, "%s: %v\n", name, exitError)
+	} else if os.IsPermission(err) {
+		fmt.Fprintf(writer, "%s: permission denied\n", name)
+	} else if os.IsNotExist(err) || errors.Is(err, exec.ErrNotFound) {
+		fmt.Fprintf(writer, "%s: command not found\n", name)
+	} else {
+		fmt.Fprintf(writer, "%s: %v\n", name, err)
+	}
+}
+
+// runInSystemShell runs line with /bin/sh, or cmd on Windows, for shell
+// features dyshell does not support itself.
+func runInSystemShell(line string, writer io.Writer) {
+	shell, args := systemShell(line)
+	executeExternalCommand(line, shell, args, writer)
+}
+
+// exitStatusOf maps the error from running a command to a shell exit status,
+// using 126 and 127 for commands that could not be run or found.
+func exitStatusOf(err error) int {
+	var exitError *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitError):
+		// A process killed by a signal gets 128 plus its number
+		if signal, ok := signalOf(exitError.ProcessState); ok {
+			return 128 + signal
+		}
+		return exitError.ExitCode()
+	case os.IsPermission(err):
+		return 126
+	case os.IsNotExist(err), errors.Is(err, exec.ErrNotFound):
+		return 127
+	default:
+		return 1
+	}
+}
+
+// findCommandPath resolves cmd to an executable path, consulting the command
+// cache first when caching is enabled.
+func findCommandPath(cmd string) (string, bool) {
+	if path, found := getCachedCommandPath(cmd); found {
+		return path, true
+	}
+	for _, path := range searchPath() {
+		fullPath := filepath.Join(path, cmd)
+		if _, err := os.Stat(fullPath); err == nil {
+			cacheCommandPath(cmd, fullPath)
+			return fullPath, true
+		}
+	}
+	return "", false
+}
+
+// emptyPathWarning makes sure the fallback for an empty PATH is only
+// reported once.
+var emptyPathWarning sync.Once
+
+// searchPath returns the directories in PATH. If PATH is unset or empty it
+// warns once and falls back to the system's standard directories.
+func searchPath() []string {
+	var paths []string
+	for _, path := range filepath.SplitList(os.Getenv("PATH")) {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) > 0 {
+		return paths
+	}
+	paths = defaultSearchPath()
+	emptyPathWarning.Do(func() {
+		message := fmt.Sprintf("dyshell: PATH is empty, searching %s\n", strings.Join(paths, string(os.PathListSeparator)))
+		if textView != nil {
+			fmt.Fprint(textView, message)
+		} else {
+			fmt.Fprint(os.Stderr, message)
+		}
+	})
+	return paths
+}
+
+// newCommand is exec.Command, but looks name up with findCommandPath so the
+// fallback for an empty PATH applies. The program still sees name as its
+// argv[0], and a name that is not found is left for exec to report.
+func newCommand(name string, args ...string) *exec.Cmd {
+	path := name
+	if !strings.ContainsRune(name, '/') && !strings.ContainsRune(name, filepath.Separator) {
+		if fullPath, found := findCommandPath(name); found {
+			path = fullPath
+		}
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Args[0] = name
+	return cmd
+}
+
+func cacheCommandPath(cmd, path string) {
+	if !shellCacheCommands {
+		return
+	}
+	mu.Lock()
+	commandCache[cmd] = path
+	mu.Unlock()
+	time.AfterFunc(cacheExpiration, func() {
+		mu.Lock()
+		delete(commandCache, cmd)
+		mu.Unlock()
+	})
+}
+
+func getCachedCommandPath(cmd string) (string, bool) {
+	if !shellCacheCommands {
+		return "", false
+	}
+	mu.Lock()
+	path, found := commandCache[cmd]
+	mu.Unlock()
+	if !found {
+		return "", false
+	}
+	// The binary may have been moved or removed since it was cached
+	if _, err := os.Stat(path); err != nil {
+		mu.Lock()
+		if commandCache[cmd] == path {
+			delete(commandCache, cmd)
+		}
+		mu.Unlock()
+		return "", false
+	}
+	return path, true
+}
+
+// clearCommandCache forgets every cached command path.
+func clearCommandCache() {
+	mu.Lock()
+	commandCache = make(map[string]string)
+	mu.Unlock()
+	pathCommands.reset()
+}
+
+// bookmarkCommand saves the current directory under a name for jump and
+// cd @name. bookmark -d removes bookmarks.
+func bookmarkCommand(args []string, writer io.Writer) {
+	if len(args) == 0 {
+		fmt.Fprintln(writer, "Usage: bookmark <name> | bookmark -d <name>...")
+		setExitStatus(1)
+		return
+	}
+	if args[0] == "-d" {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, name := range args[1:] {
+			if _, ok := bookmarks[name]; !ok {
+				fmt.Fprintf(writer, "bookmark: %s: no such bookmark\n", name)
+				setExitStatus(1)
+				continue
+			}
+			delete(bookmarks, name)
+		}
+		return
+	}
+	name := args[0]
+	if strings.ContainsAny(name, "=/ ") {
+		fmt.Fprintf(writer, "bookmark: '%s': names may not contain '=', '/' or spaces\n", name)
+		setExitStatus(1)
+		return
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(writer, "bookmark: %v\n", err)
+		setExitStatus(1)
+		return
+	}
+	mu.Lock()
+	bookmarks[name] = dir
+	mu.Unlock()
+	fmt.Fprintf(writer, "%s -> %s\n", name, dir)
+}
+
+// bookmarksCommand lists the bookmarks, optionally only those whose name or
+// directory contains a search term.
+func bookmarksCommand(args []string, writer io.Writer) {
+	term := strings.Join(args, " ")
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range bookmarkNames() {
+		if strings.Contains(name, term) || strings.Contains(bookmarks[name], term) {
+			fmt.Fprintf(writer, "%-16s %s\n", name, bookmarks[name])
+		}
+	}
+}
+
+// jumpCommand changes to a bookmarked directory.
+func jumpCommand(args []string, writer io.Writer) {
+	if len(args) != 1 {
+		fmt.Fprintln(writer, "Usage: jump <bookmark>")
+		setExitStatus(1)
+		return
+	}
+	mu.Lock()
+	_, ok := bookmarks[args[0]]
+	mu.Unlock()
+	if !ok {
+		fmt.Fprintf(writer, "jump: %s: no such bookmark\n", args[0])
+		setExitStatus(1)
+		return
+	}
+	cdCommand([]string{"@" + args[0]}, writer)
+}
+
+// bookmarkNames returns the sorted bookmark names. The caller must hold mu.
+func bookmarkNames() []string {
+	names := make([]string, 0, len(bookmarks))
+	for name := range bookmarks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func loadBookmarks(filepath string) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) == 2 {
+			mu.Lock()
+			bookmarks[parts[0]] = parts[1]
+			mu.Unlock()
+		}
+	}
+}
+
+func saveBookmarks(filepath string) {
+	file, err := os.Create(filepath)
+	if err != nil {
+		fmt.Printf("Error saving bookmarks: %v\n", err)
+		return
+	}
+	defer file.Close()
+
+	mu.Lock()
+	for _, name := range bookmarkNames() {
+		fmt.Fprintf(file, "%s=%s\n", name, bookmarks[name])
+	}
+	mu.Unlock()
+}
+
+// dirVisit is how often and how recently a directory was visited, which is
+// what z ranks directories by.
+type dirVisit struct {
+	rank float64
+	last time.Time
+}
+
+// dirVisitsMaxRank is the total rank at which all ranks are aged, so that
+// directories no longer visited eventually drop out, as in z.
+const dirVisitsMaxRank = 9000
+
+// recordDirVisit counts a visit to the working directory.
+func recordDirVisit() {
+	dir, err := os.Getwd()
+	if err != nil {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	visit, ok := dirVisits[dir]
+	if !ok {
+		visit = &dirVisit{}
+		dirVisits[dir] = visit
+	}
+	visit.rank++
+	visit.last = time.Now()
+
+	total := 0.0
+	for _, v := range dirVisits {
+		total += v.rank
+	}
+	if total > dirVisitsMaxRank {
+		for d, v := range dirVisits {
+			v.rank *= 0.99
+			if v.rank < 1 {
+				delete(dirVisits, d)
+			}
+		}
+	}
+}
+
+// frecency scores a visit by its rank weighted by how recent it was.
+func (visit *dirVisit) frecency(now time.Time) float64 {
+	switch age := now.Sub(visit.last); {
+	case age < time.Hour:
+		return visit.rank * 4
+	case age < 24*time.Hour:
+		return visit.rank * 2
+	case age < 7*24*time.Hour:
+		return visit.rank / 2
+	default:
+		return visit.rank / 4
+	}
+}
+
+// zCommand changes to the most frecent visited directory matching all of
+// the given patterns, in order and ignoring case. Without patterns, or with
+// -l, it lists the matching directories and their scores instead.
+func zCommand(args []string, writer io.Writer) {
+	list := len(args) == 0
+	if len(args) > 0 && args[0] == "-l" {
+		list = true
+		args = args[1:]
+	}
+
+	type match struct {
+		dir   string
+		score float64
+	}
+	var matches []match
+	now := time.Now()
+	mu.Lock()
+	for dir, visit := range dirVisits {
+		if matchesInOrder(strings.ToLower(dir), args) {
+			matches = append(matches, match{dir, visit.frecency(now)})
+		}
+	}
+	mu.Unlock()
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	if list {
+		for i := len(matches) - 1; i >= 0; i-- {
+			fmt.Fprintf(writer, "%-10.1f %s\n", matches[i].score, matches[i].dir)
+		}
+		return
+	}
+	for _, m := range matches {
+		// Skip directories that have been removed since
+		if isDirectory(m.dir) {
+			cdCommand([]string{m.dir}, writer)
+			return
+		}
+	}
+	fmt.Fprintf(writer, "z: no match for %s\n", strings.Join(args, " "))
+	setExitStatus(1)
+}
+
+// matchesInOrder reports whether every pattern occurs in text, each after
+// the previous one. Patterns are compared in lower case.
+func matchesInOrder(text string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		i := strings.Index(text, pattern)
+		if i == -1 {
+			return false
+		}
+		text = text[i+len(pattern):]
+	}
+	return true
+}
+
+func loadDirVisits(filepath string) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	// Lines use z's own format, dir|rank|unix time
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), "|")
+		if len(parts) != 3 {
+			continue
+		}
+		rank, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			continue
+		}
+		last, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		mu.Lock()
+		dirVisits[parts[0]] = &dirVisit{rank: rank, last: time.Unix(last, 0)}
+		mu.Unlock()
+	}
+}
+
+func saveDirVisits(filepath string) {
+	file, err := os.Create(filepath)
+	if err != nil {
+		fmt.Printf("Error saving directory history: %v\n", err)
+		return
+	}
+	defer file.Close()
+
+	mu.Lock()
+	for dir, visit := range dirVisits {
+		fmt.Fprintf(file, "%s|%g|%d\n", dir, visit.rank, visit.last.Unix())
+	}
+	mu.Unlock()
+}
+
+func reloadCommand(args []string, writer io.Writer) {
+	reloadConfig(writer)
+}
+
+// reloadConfig reads the alias, environment and bookmark files again and
+// sources the rc file. Entries in the files replace the session's; ones
+// only defined in the session are kept.
+func reloadConfig(writer io.Writer) {
+	homeDir := userHomeDir()
+	loadAliasesAndEnvVars(filepath.Join(homeDir, ".my_shell_aliases"))
+	loadEnvVars(filepath.Join(homeDir, ".my_shell_env"))
+	loadBookmarks(filepath.Join(homeDir, ".my_shell_bookmarks"))
+	loadMotd(filepath.Join(homeDir, ".my_shell_motd"))
+	// PATH may have changed
+	clearCommandCache()
+	sourceRCFile(writer)
+	fmt.Fprintln(writer, "dyshell: configuration reloaded")
+}
+
+// sourceRCFile runs ~/.my_shellrc in the current shell, as source does.
+// The lines run on the UI goroutine like typed commands, and the builtins
+// they call take mu for the state they change. A missing file is ignored.
+func sourceRCFile(writer io.Writer) {
+	path := filepath.Join(userHomeDir(), ".my_shellrc")
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	sourceCommand([]string{path}, writer)
+}
+
+func rehashCommand(args []string, writer io.Writer) {
+	clearCommandCache()
+}
+
+// motdTips are shown at random in the welcome message.
+var motdTips = []string{
+	"Press Tab to complete commands, file names and job specs.",
+	"Start a line with ! to run it with the system shell.",
+	"Use z <part of a path> to jump to a directory you visit often.",
+	"Append & to a command to run it in the background, then check on it with jobs.",
+	"Run shell completion-menu true to pick completions from a menu.",
+	"Use --dry-run in front of a command to see it fully expanded.",
+	"Run shell motd <text> to change this message, or shell motd !<command> to show a command's output.",
+}
+
+// motdCommandTimeout is how long a welcome message command may delay the
+// start of the shell.
+const motdCommandTimeout = 3 * time.Second
+
+// showMotd writes the welcome message: the version, a tip and the motd
+// setting. A setting starting with ! is run with the system shell and its
+// output shown instead. The message uses the text-color and text-bold
+// settings.
+func showMotd(writer io.Writer) {
+	style := "[" + shellTextColor + "::]"
+	if shellTextBold {
+		style = "[" + shellTextColor + "::b]"
+	}
+	fmt.Fprintf(writer, "%sWelcome to dyshell %s\n", style, tview.Escape(shellVersion()))
+	fmt.Fprintf(writer, "Tip: %s\n", tview.Escape(motdTips[time.Now().UnixNano()%int64(len(motdTips))]))
+	if command, ok := strings.CutPrefix(shellMotd, "!"); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), motdCommandTimeout)
+		defer cancel()
+		shell, args := systemShell(command)
+		output, err := exec.CommandContext(ctx, shell, args...).CombinedOutput()
+		fmt.Fprint(writer, tview.Escape(string(output)))
+		if err != nil {
+			fmt.Fprintf(writer, "motd: %s: %v\n", command, err)
+		}
+	} else if shellMotd != "" {
+		fmt.Fprintln(writer, tview.Escape(shellMotd))
+	}
+	fmt.Fprint(writer, "[-:-:-]\n")
+}
+
+// shellVersion returns the version dyshell was built as, which is only
+// known when it was installed with go install.
+func shellVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+func loadMotd(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	shellMotd = strings.TrimSuffix(string(data), "\n")
+}
+
+func saveMotd(path string) {
+	if shellMotd == "" {
+		os.Remove(path)
+		return
+	}
+	if err := os.WriteFile(path, []byte(shellMotd+"\n"), 0644); err != nil {
+		fmt.Printf("Error saving welcome message: %v\n", err)
+	}
+}
+
+func loadEnvVars(filepath string) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 {
+			mu.Lock()
+			envVars[parts[0]] = parts[1]
+			mu.Unlock()
+			os.Setenv(parts[0], parts[1])
+		}
+	}
+}
+
+// dotenvCommand loads KEY=VALUE pairs from .env style files into the
+// environment.
+func dotenvCommand(args []string, writer io.Writer) {
+	if len(args) == 0 {
+		args = []string{".env"}
+	}
+	for _, file := range args {
+		count, err := loadDotenv(file)
+		if err != nil {
+			setExitStatus(1)
+			fmt.Fprintf(writer, "dotenv: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(writer, "dotenv: loaded %d variable(s) from %s\n", count, file)
+	}
+}
+
+// maxSourceDepth bounds how deeply scripts may source one another, so a
+// script that sources itself fails instead of recursing forever.
+const maxSourceDepth = 64
+
+var sourceDepth int
+
+// sourceCommand runs the lines of a script file in the current shell. Like
+// other shells it ignores a #! line, which is a comment.
+func sourceCommand(args []string, writer io.Writer) {
+	if len(args) == 0 {
+		setExitStatus(2)
+		fmt.Fprintln(writer, "source: filename argument required")
+		return
+	}
+	path := args[0]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		setExitStatus(1)
+		fmt.Fprintf(writer, "source: %v\n", err)
+		return
+	}
+
+	if sourceDepth >= maxSourceDepth {
+		setExitStatus(1)
+		fmt.Fprintf(writer, "source: %s: maximum nesting depth exceeded\n", path)
+		return
+	}
+	// The lines may wait for foreground jobs, so the depth is tracked in
+	// the same queue as the lines themselves
+	afterForeground(func() { sourceDepth++ })
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			runLine(line)
+		}
+	}
+	afterForeground(func() { sourceDepth-- })
+}
+
+// runScript runs a script file named on the command line, as in
+// "dyshell script.sh", and returns its exit status. When its #! line names
+// another interpreter, the file and the remaining arguments are handed to
+// that interpreter. Otherwise its lines run in the shell as source runs
+// them, with the output going to the transcript.
+func runScript(path string, args []string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dyshell: %v\n", err)
+		return 127
+	}
+	if interpreter := shebangInterpreter(data); interpreter != nil {
+		cmd := newCommand(interpreter[0], append(append(interpreter[1:], path), args...)...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		var exitError *exec.ExitError
+		if err != nil && !errors.As(err, &exitError) {
+			reportCommandError(os.Stderr, interpreter[0], err)
+		}
+		return exitStatusOf(err)
+	}
+
+	sourceCommand([]string{path}, newDisplayWriter())
+	// Without the interface nothing else runs the commands waiting for a
+	// foreground job, so wait for each job here
+	for {
+		mu.Lock()
+		job := foregroundJob
+		mu.Unlock()
+		if job != nil {
+			<-job.done
+		}
+		if len(pendingCommands) == 0 {
+			break
+		}
+		runPendingCommands()
+	}
+	return exitStatus()
+}
+
+// runScriptFile runs a script without the interface: the views commands
+// write to are never shown, and the transcript is copied to standard
+// output as it grows.
+func runScriptFile(path string, args []string) int {
+	var copied sync.Mutex
+	written := 0
+	// The view reports changes from goroutines of its own, so whatever is
+	// left is copied once more at the end
+	copyOutput := func() {
+		copied.Lock()
+		defer copied.Unlock()
+		text := textView.GetText(true)
+		os.Stdout.WriteString(text[written:])
+		written = len(text)
+	}
+	runningScript = true
+	textView = tview.NewTextView().SetChangedFunc(copyOutput)
+	inputView = &inputLine{tview.NewTextView()}
+	statusBar = tview.NewTextView()
+	status := runScript(path, args)
+	copyOutput()
+	return status
+}
+
+// shebangInterpreter returns the interpreter and its arguments from the #!
+// line at the start of a script, or nil if the script has none or names
+// dyshell itself. "/usr/bin/env prog" is reduced to prog, and an
+// interpreter path that does not exist here, as on Windows, falls back to
+// its base name looked up in PATH.
+func shebangInterpreter(data []byte) []string {
+	line, _, _ := strings.Cut(string(data), "\n")
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), "#!")
+	if !ok {
+		return nil
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return nil
+	}
+	if path.Base(filepath.ToSlash(fields[0])) == "env" && len(fields) > 1 {
+		fields = fields[1:]
+	} else if _, err := os.Stat(fields[0]); err != nil {
+		fields[0] = path.Base(filepath.ToSlash(fields[0]))
+	}
+	name := strings.TrimSuffix(path.Base(filepath.ToSlash(fields[0])), ".exe")
+	if name == "dyshell" {
+		return nil
+	}
+	return fields
+}
+
+// loadDotenv sets every variable defined in a .env file and returns how
+// many were set. Lines may start with "export ", values may be single or
+// double quoted, and # starts a comment outside of quotes.
+func loadDotenv(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, err := parseDotenvLine(line)
+		if err != nil {
+			return count, fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+		if isReadonly(key) {
+			return count, fmt.Errorf("%s:%d: %s: readonly variable", path, lineNumber, key)
+		}
+		mu.Lock()
+		envVars[key] = value
+		mu.Unlock()
+		os.Setenv(key, value)
+		count++
+	}
+	return count, scanner.Err()
+}
+
+func parseDotenvLine(line string) (string, string, error) {
+	line = strings.TrimPrefix(line, "export ")
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("expected KEY=VALUE")
+	}
+	key := strings.TrimSpace(parts[0])
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", fmt.Errorf("invalid variable name '%s'", key)
+	}
+	value := strings.TrimSpace(parts[1])
+	switch {
+	case strings.HasPrefix(value, "'"):
+		end := strings.Index(value[1:], "'")
+		if end == -1 {
+			return "", "", errors.New("unterminated single quote")
+		}
+		return key, value[1 : end+1], nil
+	case strings.HasPrefix(value, "\""):
+		var b strings.Builder
+		for i := 1; i < len(value); i++ {
+			switch c := value[i]; {
+			case c == '"':
+				return key, b.String(), nil
+			case c == '\\' && i+1 < len(value):
+				i++
+				switch value[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(value[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", "", errors.New("unterminated double quote")
+	}
+	if i := strings.Index(value, " #"); i != -1 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return key, value, nil
+}
+
+func saveEnvVars(filepath string) {
+	file, err := os.Create(filepath)
+	if err != nil {
+		fmt.Printf("Error saving environment variables: %v\n", err)
+		return
+	}
+	defer file.Close()
+
+	mu.Lock()
+	for k, v := range envVars {
+		fmt.Fprintf(file, "%s=%s\n", k, v)
+	}
+	mu.Unlock()
+}
+
+// expandVariable resolves a $name reference. On top of the environment it
+// knows the shell's special parameters, such as $! for the PID of the most
+// recent background job.
+func expandVariable(name string) string {
+	switch name {
+	case "?":
+		return strconv.Itoa(exitStatus())
+	case "!":
+		mu.Lock()
+		defer mu.Unlock()
+		if lastBgPid == 0 {
+			return ""
+		}
+		return strconv.Itoa(lastBgPid)
+	}
+	mu.Lock()
+	value, ok := shellVars[name]
+	mu.Unlock()
+	if ok {
+		return value
+	}
+	return os.Getenv(name)
+}
+
+func substituteCommand(cmdLine string) string {
+	for {
+		start := strings.Index(cmdLine, "$(")
+		if start == -1 {
+			break
+		}
+		end := matchingParen(cmdLine, start+1)
+		if end == -1 {
+			break
+		}
+		// Always replace the substitution, so a failing one cannot be
+		// retried forever
+		cmdLine = cmdLine[:start] + commandOutput(cmdLine[start+2:end]) + cmdLine[end+1:]
+	}
+	return cmdLine
+}
+
+// commandOutput runs the command of a $(...) substitution and returns what
+// it printed, even if it failed.
+func commandOutput(subCmd string) string {
+	// Expand dyshell's own variables first, so the substitution sees shell
+	// variables as well as exported ones. Values are escaped and single
+	// quotes are left alone, so the system shell reads them as data. The
+	// commands it runs only inherit the environment, which holds just the
+	// exported ones.
+	subCmd = expandWords(subCmd)
+	output, _ := exec.Command("/bin/sh", "-c", subCmd).Output()
+	return strings.TrimSpace(string(output))
+}
+
+// matchingParen returns the index of the parenthesis closing the one at
+// open, or -1 if it is not closed.
+func matchingParen(line string, open int) int {
+	depth := 0
+	for i := open; i < len(line); i++ {
+		switch line[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// expandWords performs command substitution and variable expansion on a
+// command line according to the quoting around them, so nothing inside
+// single quotes is expanded. The results are escaped for tokenize: inside
+// double quotes they stay a single word, elsewhere they are split at
+// spaces, but quotes and operators in them never take effect.
+func expandWords(line string) string {
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			}
+		case c == '\\' && i+1 < len(line):
+			b.WriteByte(c)
+			i++
+			c = line[i]
+		case c == '"':
+			if quote == '"' {
+				quote = 0
+			} else {
+				quote = '"'
+			}
+		case c == '\'' && quote == 0:
+			quote = '\''
+		case c == '$' && strings.HasPrefix(line[i:], "$("):
+			end := matchingParen(line, i+1)
+			if end == -1 {
+				break
+			}
+			b.WriteString(escapeExpansion(commandOutput(line[i+2:end]), quote == '"'))
+			i = end
+			continue
+		case c == '$':
+			if n := variableNameLength(line[i+1:]); n > 0 {
+				b.WriteString(escapeExpansion(os.Expand(line[i:i+1+n], expandVariable), quote == '"'))
+				i += n
+				continue
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// variableNameLength returns the length of the variable reference that s,
+// the text after a $, starts with, read the way os.Expand reads it. It is
+// 0 when there is none and the $ is taken literally.
+func variableNameLength(s string) int {
+	if s == "" {
+		return 0
+	}
+	if s[0] == '{' {
+		if end := strings.IndexByte(s, '}'); end > 1 {
+			return end + 1
+		}
+		return 0
+	}
+	if strings.IndexByte("*#$@!?-0123456789", s[0]) >= 0 {
+		return 1
+	}
+	n := 0
+	for n < len(s) && (s[n] == '_' || s[n] >= 'a' && s[n] <= 'z' || s[n] >= 'A' && s[n] <= 'Z' || s[n] >= '0' && s[n] <= '9') {
+		n++
+	}
+	return n
+}
+
+// escapeExpansion escapes the result of an expansion so that tokenize takes
+// it literally, within double quotes or outside of any quotes.
+func escapeExpansion(value string, inDoubleQuotes bool) string {
+	special := "\\'\"$`|&;<>#"
+	if inDoubleQuotes {
+		special = "\\\"$`"
+	}
+	var b strings.Builder
+	for _, c := range value {
+		if strings.ContainsRune(special, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// indexUnquoted returns the index of the first substr in line that is not
+// inside single quotes or escaped, or -1.
+func indexUnquoted(line, substr string) int {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			}
+		case c == '\\':
+			i++
+		case c == '"':
+			if quote == '"' {
+				quote = 0
+			} else {
+				quote = '"'
+			}
+		case c == '\'' && quote == 0:
+			quote = '\''
+		case strings.HasPrefix(line[i:], substr):
+			return i
+		}
+	}
+	return -1
+}
+
+// stripComment removes a # comment from the end of line. Like POSIX shells
+// it only treats # as a comment at the start of a word and outside quotes,
+// so "a#b" and URLs with fragments are left alone.
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimSpace(line[:i])
+		}
+	}
+	return line
+}
+
+// tokenize splits a command line into words the way a shell does. Single
+// quotes keep everything up to the closing quote as it is, and double quotes
+// keep spaces and single quotes. Quoted text can be part of a longer word,
+// as in --name="a b". Outside single quotes a backslash escapes the next
+// character if it would otherwise be special, so Windows paths such as
+// C:\Users keep their backslashes.
+func tokenize(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`", runes[i+1]) {
+				i++
+				word.WriteRune(runes[i])
+			} else {
+				word.WriteRune(c)
+			}
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == '\\' && i+1 < len(runes) && runes[i+1] == '\n':
+			// A line continuation
+			i++
+		case c == '\\' && i+1 < len(runes) && strings.ContainsRune(" \t'\"\\$`|&;<>#", runes[i+1]):
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	switch quote {
+	case '\'':
+		return nil, errors.New("unterminated single quote")
+	case '"':
+		return nil, errors.New("unterminated double quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// splitUnquoted splits line at every sep that is neither quoted, escaped
+// nor inside parentheses such as those of a $(...) substitution.
+func splitUnquoted(line string, sep rune) []string {
+	var parts []string
+	var quote rune
+	start := 0
+	depth := 0
+	escaped := false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, line[start:i])
+			start = i + utf8.RuneLen(c)
+		}
+	}
+	return append(parts, line[start:])
+}
+
+// parseAssignment recognises a command line that is a single NAME=value
+// assignment and returns the name and expanded value. The value may be a
+// quoted string or a command substitution containing spaces; anything else
+// with a space in it is a command run with a modified environment, which is
+// not an assignment.
+func parseAssignment(cmdLine string) (name, value string, ok bool) {
+	name, value, found := strings.Cut(cmdLine, "=")
+	if !found || !isValidVariableName(name) {
+		return "", "", false
+	}
+	quoted := len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0]
+	switch {
+	case quoted && value[0] == '\'':
+		return name, value[1 : len(value)-1], true
+	case quoted:
+		value = value[1 : len(value)-1]
+	case strings.HasPrefix(value, "$(") && strings.HasSuffix(value, ")") && strings.Count(value, "$(") == 1:
+	case strings.ContainsAny(value, " \t"):
+		return "", "", false
+	}
+	return name, os.Expand(substituteCommand(value), expandVariable), true
+}
+
+// isValidVariableName reports whether name can be used as a variable name.
+func isValidVariableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// setVariable assigns a shell variable. Variables that have been exported
+// keep their value in the environment up to date as well. Readonly variables
+// cannot be assigned, and integer ones store the arithmetic value of value.
+func setVariable(name, value string) error {
+	mu.Lock()
+	readonly, integer := readonlyVars[name], integerVars[name]
+	mu.Unlock()
+	if readonly {
+		return fmt.Errorf("%s: readonly variable", name)
+	}
+	if integer {
+		// Evaluated without holding mu, as expandVariable takes it
+		n, err := evalArithmetic(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		value = strconv.FormatInt(n, 10)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if _, exported := envVars[name]; exported {
+		envVars[name] = value
+		os.Setenv(name, value)
+		return nil
+	}
+	if _, inEnv := os.LookupEnv(name); inEnv {
+		os.Setenv(name, value)
+		return nil
+	}
+	shellVars[name] = value
+	return nil
+}
+
+type AutoCompleter struct{}
+
+// Do returns the candidates for the word ending at pos along with the length
+// of that word, so callers can replace it with the chosen candidate.
+func (a *AutoCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	text := string(line[:pos])
+	words := strings.Fields(text)
+	prefix := ""
+	if len(words) > 0 && !strings.HasSuffix(text, " ") {
+		prefix = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+
+	// Settings made with the complete builtin take precedence over what
+	// dyshell knows about the command's arguments
+	var spec completionSpec
+	var hasSpec bool
+	if len(words) > 0 {
+		mu.Lock()
+		spec, hasSpec = completionSpecs[words[0]]
+		mu.Unlock()
+	}
+
+	var candidates []string
+	if len(words) == 0 {
+		// A command given by its path is completed like any other path
+		if !strings.Contains(prefix, "/") {
+			candidates = getAllCommands()
+		}
+	} else if spec.words != nil {
+		candidates = spec.words
+	} else if hasSpec && (spec.dirsOnly || spec.files) {
+		// Left nil, so that file names are completed below
+	} else if _, ok := commandFlags[words[0]]; ok && strings.HasPrefix(prefix, "-") {
+		candidates = completeFlags(words)
+	} else {
+		candidates = completeArgs(words)
+	}
+
+	var suggestions [][]rune
+	if candidates == nil {
+		// Anything else is completed as a file path. The candidates are
+		// whole paths that may differ from prefix in every component.
+		dirsOnly := spec.dirsOnly || (len(words) > 0 && (words[0] == "cd" || words[0] == "pushd"))
+		for _, candidate := range completePath(prefix, dirsOnly) {
+			if spec.matches(candidate) {
+				suggestions = append(suggestions, []rune(candidate))
+			}
+		}
+		return suggestions, len([]rune(prefix))
+	}
+	for _, candidate := range candidates {
+		if hasCompletionPrefix(candidate, prefix) {
+			suggestions = append(suggestions, []rune(candidate))
+		}
+	}
+	return suggestions, len([]rune(prefix))
+}
+
+// completePath completes a file path. Every directory component along the
+// way may be incomplete too, as in fish and zsh, so /usr/lo/sh completes to
+// /usr/local/share. Components matching several directories are followed
+// into each of them. Directories are completed with a trailing slash, and
+// with dirsOnly they are the only candidates.
+func completePath(prefix string, dirsOnly bool) []string {
+	components := strings.Split(prefix, "/")
+	dirs := []string{""}
+	for i, component := range components[:len(components)-1] {
+		var next []string
+		for _, dir := range dirs {
+			// Keep components that already name a directory as typed
+			if component == "" || component == "." || component == ".." || (i == 0 && component == "~") {
+				next = append(next, dir+component+"/")
+				continue
+			}
+			if info, err := os.Stat(expandTilde(dir + component)); err == nil && info.IsDir() {
+				next = append(next, dir+component+"/")
+				continue
+			}
+			for _, name := range matchingEntries(dir, component) {
+				if isDirectory(dir + name) {
+					next = append(next, dir+name+"/")
+				}
+			}
+		}
+		dirs = next
+	}
+
+	last := components[len(components)-1]
+	var candidates []string
+	for _, dir := range dirs {
+		for _, name := range matchingEntries(dir, last) {
+			if isDirectory(dir + name) {
+				name += "/"
+			} else if dirsOnly {
+				continue
+			}
+			candidates = append(candidates, dir+name)
+		}
+	}
+	return candidates
+}
+
+// matchingEntries returns the names in dir ("" for the working directory)
+// that complete partial. Hidden files are only offered once partial starts
+// with a dot.
+func matchingEntries(dir, partial string) []string {
+	path := expandTilde(dir)
+	if path == "" {
+		path = "."
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(partial, ".") {
+			continue
+		}
+		if hasCompletionPrefix(name, partial) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// isDirectory reports whether path, which may start with ~, is a directory
+// or a symbolic link to one.
+func isDirectory(path string) bool {
+	info, err := os.Stat(expandTilde(path))
+	return err == nil && info.IsDir()
+}
+
+// hasCompletionPrefix reports whether candidate completes prefix under the
+// completion-case option: "insensitive" ignores case, and "smart" ignores it
+// unless prefix contains an upper case letter.
+func hasCompletionPrefix(candidate, prefix string) bool {
+	switch shellCompletionCase {
+	case "insensitive":
+	case "smart":
+		if strings.ToLower(prefix) != prefix {
+			return strings.HasPrefix(candidate, prefix)
+		}
+	default:
+		return strings.HasPrefix(candidate, prefix)
+	}
+	return strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(prefix))
+}
+
+// completeJobs returns a %n job spec for every running or stopped job, and
+// with plainNumbers the bare job numbers too.
+func completeJobs(plainNumbers bool) []string {
+	mu.Lock()
+	defer mu.Unlock()
+	candidates := []string{}
+	for _, job := range jobs {
+		if job.isDone() {
+			continue
+		}
+		candidates = append(candidates, "%"+strconv.Itoa(job.ID))
+		if plainNumbers {
+			candidates = append(candidates, strconv.Itoa(job.ID))
+		}
+	}
+	return candidates
+}
+
+// completionAnnotation returns the text shown next to a candidate in the
+// completion menu: the command line of the job a job spec refers to.
+func completionAnnotation(candidate string) string {
+	if !strings.HasPrefix(candidate, "%") {
+		return ""
+	}
+	if job, _ := findJob(candidate); job != nil {
+		return job.Line
+	}
+	return ""
+}
+
+// completionSpec narrows down the file names offered when completing the
+// arguments of a command. Directories are always offered, so that the
+// completion can descend into them.
+type completionSpec struct {
+	include  string   // only offer names matching this pattern
+	exclude  string   // never offer names matching this pattern
+	dirsOnly bool     // only offer directories
+	files    bool     // offer file names even where the command has its own candidates
+	words    []string // offer these words instead of file names
+}
+
+// matches reports whether the file name candidate passes the spec.
+func (spec completionSpec) matches(candidate string) bool {
+	if strings.HasSuffix(candidate, "/") {
+		return true
+	}
+	name := filepath.Base(candidate)
+	if spec.include != "" {
+		if matched, _ := filepath.Match(spec.include, name); !matched {
+			return false
+		}
+	}
+	if spec.exclude != "" {
+		if matched, _ := filepath.Match(spec.exclude, name); matched {
+			return false
+		}
+	}
+	return true
+}
+
+// completeCommand sets how the arguments of commands are completed. -d only
+// offers directories, -f always offers file names, and -W offers a list of
+// words instead. -G only offers names matching a pattern and -X leaves out
+// names matching one. -r removes the settings for the named commands, and
+// without any arguments the current settings are listed.
+func completeCommand(args []string, writer io.Writer) {
+	usage := func() {
+		fmt.Fprintln(writer, "Usage: complete [-df] [-W wordlist] [-G pattern] [-X pattern] name... | complete -r name...")
+		setExitStatus(2)
+	}
+	if len(args) == 0 {
+		mu.Lock()
+		names := make([]string, 0, len(completionSpecs))
+		for name := range completionSpecs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			spec := completionSpecs[name]
+			line := "complete"
+			if spec.dirsOnly {
+				line += " -d"
+			}
+			if spec.files {
+				line += " -f"
+			}
+			if spec.words != nil {
+				line += fmt.Sprintf(" -W '%s'", strings.Join(spec.words, " "))
+			}
+			if spec.include != "" {
+				line += fmt.Sprintf(" -G '%s'", spec.include)
+			}
+			if spec.exclude != "" {
+				line += fmt.Sprintf(" -X '%s'", spec.exclude)
+			}
+			fmt.Fprintln(writer, line+" "+name)
+		}
+		mu.Unlock()
+		return
+	}
+	if args[0] == "-r" {
+		if len(args) == 1 {
+			usage()
+			return
+		}
+		mu.Lock()
+		for _, name := range args[1:] {
+			delete(completionSpecs, name)
+		}
+		mu.Unlock()
+		return
+	}
+
+	var spec completionSpec
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-d":
+			spec.dirsOnly = true
+			args = args[1:]
+			continue
+		case "-f":
+			spec.files = true
+			args = args[1:]
+			continue
+		case "-W", "-G", "-X":
+		default:
+			fmt.Fprintf(writer, "complete: %s: invalid option\n", args[0])
+			usage()
+			return
+		}
+		if len(args) < 2 {
+			fmt.Fprintf(writer, "complete: %s: option requires an argument\n", args[0])
+			usage()
+			return
+		}
+		if args[0] == "-W" {
+			spec.words = strings.Fields(args[1])
+			args = args[2:]
+			continue
+		}
+		pattern := args[1]
+		if err := checkPattern(pattern); err != nil {
+			fmt.Fprintf(writer, "complete: invalid pattern '%s': %v\n", pattern, err)
+			setExitStatus(1)
+			return
+		}
+		if args[0] == "-G" {
+			spec.include = pattern
+		} else {
+			spec.exclude = pattern
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		usage()
+		return
 	}
-}
-
-func jobsCommand(args []string, writer io.Writer) {
 	mu.Lock()
-	for i, job := range jobs {
-		fmt.Fprintf(writer, "[%d]+  %d Running    %s\n", i+1, job.Process.Pid, strings.Join(job.Args, " "))
+	for _, name := range args {
+		completionSpecs[name] = spec
 	}
 	mu.Unlock()
 }
 
-func fgCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		jobNumber, err := strconv.Atoi(args[0])
-		if err == nil && jobNumber > 0 && jobNumber <= len(jobs) {
-			mu.Lock()
-			job := jobs[jobNumber-1]
-			mu.Unlock()
-			job.Wait()
-		} else {
-			fmt.Fprintf(writer, "fg: %s: no such job\n", args[0])
+// checkPattern reports whether pattern is a malformed glob. filepath.Match
+// stops checking at the first mismatch, but a * can match nothing, so with
+// every * read as ? the whole pattern is one chunk that it checks in full.
+func checkPattern(pattern string) error {
+	_, err := filepath.Match(strings.ReplaceAll(pattern, "*", "?"), "")
+	return err
+}
+
+// commandFlags lists the flags of builtins, offered when completing a word
+// starting with a dash.
+var commandFlags = map[string][]string{
+	"chown":    {"-R"},
+	"complete": {"-G", "-W", "-X", "-d", "-f", "-r"},
+	"declare":  {"-i", "-p", "-r", "-x"},
+	"du":       {"-h", "-s"},
+	"exit":     {"-f"},
+	"fc":       {"-l"},
+	"find":     {"-name", "-type"},
+	"grep":     {"-i", "-n"},
+	"head":     {"-n"},
+	"history":  {"--grep", "--since", "-c"},
+	"jobs":     {"-l", "-p"},
+	"ln":       {"-f", "-s"},
+	"ls":       {"-F", "-S", "-h", "-l", "-r", "-t"},
+	"readlink": {"-e", "-f", "-m"},
+	"readonly": {"-p"},
+	"realpath": {"-e", "-m"},
+	"sort":     {"-f", "-n", "-r", "-u"},
+	"stat":     {"-c"},
+	"tail":     {"-n"},
+	"typeset":  {"-i", "-p", "-r", "-x"},
+	"watch":    {"-c", "-n", "-p"},
+	"wc":       {"-c", "-l", "-w"},
+}
+
+// completeFlags returns the flags of the command words[0] that are not
+// already on the line. The result is never nil, so that running out of
+// flags does not fall back to completing file names.
+func completeFlags(words []string) []string {
+	remaining := []string{}
+	for _, flag := range commandFlags[words[0]] {
+		if !flagGiven(flag, words[1:]) {
+			remaining = append(remaining, flag)
 		}
 	}
+	return remaining
 }
 
-func bgCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		jobNumber, err := strconv.Atoi(args[0])
-		if err == nil && jobNumber > 0 && jobNumber <= len(jobs) {
-			mu.Lock()
-			job := jobs[jobNumber-1]
-			mu.Unlock()
-			var _ *exec.Cmd = job
-			err := sendSignalContinue()
-			if err != nil {
-				fmt.Fprintf(writer, "Failed to send continue signal: %v\n", err)
-			}
-		} else {
-			fmt.Fprintf(writer, "bg: %s: no such job\n", args[0])
+// flagGiven reports whether flag appears in words, either on its own or,
+// for a single letter flag, combined with others as in "ls -lh".
+func flagGiven(flag string, words []string) bool {
+	for _, word := range words {
+		if word == flag {
+			return true
+		}
+		if len(flag) == 2 && len(word) > 2 && word[0] == '-' && word[1] != '-' && strings.IndexByte(word[1:], flag[1]) >= 0 {
+			return true
 		}
 	}
+	return false
 }
 
-func killCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		pid, err := strconv.Atoi(args[0])
-		if err == nil {
-			process, err := os.FindProcess(pid)
-			if err == nil {
-				err = process.Kill()
-				if err == nil {
-					fmt.Fprintf(writer, "Process %d killed\n", pid)
-				} else {
-					fmt.Fprintf(writer, "Failed to kill process %d: %v\n", pid, err)
-				}
-			} else {
-				fmt.Fprintf(writer, "Failed to find process %d: %v\n", pid, err)
-			}
-		} else {
-			fmt.Fprintf(writer, "Invalid PID: %s\n", args[0])
+// completeArgs returns the argument candidates for a command line whose
+// complete words so far are words.
+func completeArgs(words []string) []string {
+	switch words[0] {
+	case "fg", "bg", "kill", "wait", "disown":
+		return completeJobs(words[0] == "fg" || words[0] == "bg")
+	case "jump", "bookmark":
+		if words[0] == "jump" && len(words) == 1 || words[0] == "bookmark" && len(words) > 1 && words[1] == "-d" {
+			mu.Lock()
+			defer mu.Unlock()
+			return bookmarkNames()
+		}
+	case "shell":
+		if len(words) == 1 {
+			return append([]string{"expand", "reset"}, shellOptions...)
+		}
+		if len(words) == 2 && words[1] == "text-color" {
+			return colorNames()
+		}
+		if len(words) == 2 && words[1] == "completion-case" {
+			return []string{"sensitive", "insensitive", "smart"}
+		}
+		if len(words) == 2 && words[1] == "reset" {
+			return append([]string{"all"}, shellOptions...)
 		}
-	} else {
-		fmt.Fprintln(writer, "kill: missing PID operand")
 	}
+	return nil
 }
 
-func shellCustomizationCommand(args []string, writer io.Writer) {
-	if len(args) > 0 {
-		handleShellCustomization(args, writer)
-	} else {
-		printShellCustomization(writer)
+// colorNames returns the sorted list of color names known to tcell.
+func colorNames() []string {
+	names := make([]string, 0, len(tcell.ColorNames))
+	for name := range tcell.ColorNames {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
 
-func handleShellCustomization(args []string, writer io.Writer) {
-	if len(args) < 2 {
-		fmt.Fprintln(writer, "Usage: shell [option] [value]")
-		return
+// executePipedCommands runs a pipeline. The output of its last stage and
+// the errors of every stage go to writer.
+func executePipedCommands(cmdLine string, writer io.Writer) {
+	commands := splitUnquoted(cmdLine, '|')
+	stages := make([]pipelineStage, 0, len(commands))
+
+	for _, cmdStr := range commands {
+		cmdArgs, err := tokenize(cmdStr)
+		if err != nil {
+			fmt.Fprintf(writer, "dyshell: %v\n", err)
+			return
+		}
+		if len(cmdArgs) == 0 {
+			fmt.Fprintln(writer, "syntax error near unexpected token '|'")
+			return
+		}
+		if builtinFunc, ok := builtins[cmdArgs[0]]; ok {
+			stages = append(stages, pipelineStage{args: cmdArgs, builtin: builtinFunc})
+			continue
+		}
+		// A missing program fails the whole pipeline before anything runs
+		cmd := newCommand(cmdArgs[0], cmdArgs[1:]...)
+		if cmd.Err != nil {
+			reportCommandError(writer, cmdArgs[0], cmd.Err)
+			setExitStatus(exitStatusOf(cmd.Err))
+			return
+		}
+		stages = append(stages, pipelineStage{args: cmdArgs, cmd: cmd})
 	}
 
-	option := args[0]
-	value := strings.Join(args[1:], " ")
+	// The stages write concurrently, so they share writer through a lock
+	output := &syncWriter{Writer: writer}
 
-	switch option {
-	case "bg-opacity":
-		opacity, err := strconv.Atoi(value)
-		if err == nil && opacity >= 0 && opacity <= 100 {
-			shellBgOpacity = opacity
-			fmt.Fprintf(writer, "Background opacity set to %d%%\n", shellBgOpacity)
-		} else {
-			fmt.Fprintln(writer, "Invalid opacity value. Please enter a value between 0 and 100.")
+	// Connect each stage to the next with an OS pipe rather than StdoutPipe,
+	// so the stages stream into each other directly while we wait on them.
+	var pipeEnds []*os.File
+	for i := 0; i < len(stages)-1; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			fmt.Fprintf(writer, "pipe: %v\n", err)
+			closeFiles(pipeEnds)
+			return
 		}
-	case "text-size":
-		size, err := strconv.Atoi(value)
-		if err == nil && size > 0 {
-			shellTextSize = size
-			fmt.Fprintf(writer, "Text size set to %d\n", shellTextSize)
-		} else {
-			fmt.Fprintln(writer, "Invalid text size. Please enter a positive integer.")
+		stages[i].stdout = w
+		stages[i+1].stdin = r
+		pipeEnds = append(pipeEnds, r, w)
+	}
+
+	// Every external stage joins the process group of the first one, so the
+	// whole pipeline can be suspended and resumed as a single job.
+	var started []*exec.Cmd
+	var lastCmd *exec.Cmd
+	var running sync.WaitGroup
+	pgid := 0
+	setExitStatus(0)
+	for i := range stages {
+		stage := &stages[i]
+		if stage.builtin != nil {
+			continue
 		}
-	case "text-color":
-		shellTextColor = value
-		fmt.Fprintf(writer, "Text color set to %s\n", shellTextColor)
-	case "text-bold":
-		if value == "true" {
-			shellTextBold = true
-			fmt.Fprintln(writer, "Text bold set to true")
-		} else if value == "false" {
-			shellTextBold = false
-			fmt.Fprintln(writer, "Text bold set to false")
-		} else {
-			fmt.Fprintln(writer, "Invalid value for text-bold. Use true or false.")
+		cmd := stage.cmd
+		cmd.Stdout = output
+		if stage.stdout != nil {
+			cmd.Stdout = stage.stdout
 		}
-	case "prompt-style":
-		shellPromptStyle = value
-		fmt.Fprintf(writer, "Prompt style set to %s\n", shellPromptStyle)
-	default:
-		fmt.Fprintln(writer, "Unknown customization option.")
+		if stage.stdin != nil {
+			cmd.Stdin = stage.stdin
+		}
+		cmd.Stderr = output
+		setProcessGroup(cmd, pgid)
+		if err := cmd.Start(); err != nil {
+			// Abort the pipeline, stopping the stages already started
+			reportCommandError(output, cmd.Args[0], err)
+			setExitStatus(exitStatusOf(err))
+			for _, cmd := range started {
+				cmd.Process.Kill()
+				cmd.Wait()
+			}
+			closeFiles(pipeEnds)
+			return
+		}
+		if i == len(stages)-1 {
+			lastCmd = cmd
+		}
+		if pgid == 0 {
+			pgid = processGroupOf(cmd)
+		}
+		started = append(started, cmd)
+	}
+
+	// The children hold their own copies of the pipe ends now. Closing ours
+	// lets each reader see EOF as soon as the stage writing to it exits, and
+	// keeps descriptors from accumulating across pipelines. Builtin stages
+	// run in this process, so they close their own ends when they finish.
+	for i := range stages {
+		if stages[i].builtin == nil {
+			closeFiles(stages[i].files())
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	hasBuiltins := false
+	for i := range stages {
+		if stages[i].builtin != nil {
+			hasBuiltins = true
+			running.Add(1)
+			go runPipelineBuiltin(ctx, &stages[i], output, &running)
+		}
+	}
+
+	if len(started) == 0 && !hasBuiltins {
+		cancel()
+		return
 	}
+	job := &Job{Cmds: started, Line: cmdLine, Pgid: pgid, builtins: &running, cancel: cancel, lastCmd: lastCmd, started: time.Now(), done: make(chan struct{})}
+	mu.Lock()
+	foregroundJob = job
+	mu.Unlock()
+	go waitJob(job)
 }
 
-func printShellCustomization(writer io.Writer) {
-	fmt.Fprintln(writer, "Shell Customization Options:")
-	fmt.Fprintf(writer, "bg-opacity: %d%%\n", shellBgOpacity)
-	fmt.Fprintf(writer, "text-size: %d\n", shellTextSize)
-	fmt.Fprintf(writer, "text-color: %s\n", shellTextColor)
-	fmt.Fprintf(writer, "text-bold: %t\n", shellTextBold)
-	fmt.Fprintf(writer, "prompt-style: %s\n", shellPromptStyle)
+// syncWriter serialises writes to Writer from several goroutines.
+type syncWriter struct {
+	sync.Mutex
+	io.Writer
 }
 
-func executeExternalCommand(path string, args []string, writer io.Writer) {
-	cmd := exec.Command(path, args...)
-	cmd.Stdout = writer
-	cmd.Stderr = writer
-	if err := cmd.Run(); err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			fmt.Fprintf(writer, "%s: %v\n", cmd.Args[0], exitError)
-		} else if os.IsPermission(err) {
-			fmt.Fprintf(writer, "%s: permission denied\n", cmd.Args[0])
-		} else if os.IsNotExist(err) {
-			fmt.Fprintf(writer, "%s: command not found\n", cmd.Args[0])
-		} else {
-			fmt.Fprintf(writer, "%s: %v\n", cmd.Args[0], err)
-		}
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.Writer.Write(p)
+}
+
+// pipelineStage is one command of a pipeline, either an external command or
+// a builtin. stdin and stdout are the pipe ends connecting it to its
+// neighbours and are nil at the ends of the pipeline.
+type pipelineStage struct {
+	args    []string
+	cmd     *exec.Cmd
+	builtin func([]string, io.Writer)
+	stdin   *os.File
+	stdout  *os.File
+}
+
+// files returns the pipe ends used by the stage.
+func (stage *pipelineStage) files() []*os.File {
+	var files []*os.File
+	if stage.stdin != nil {
+		files = append(files, stage.stdin)
 	}
+	if stage.stdout != nil {
+		files = append(files, stage.stdout)
+	}
+	return files
 }
 
-func cacheCommandPath(cmd, path string) {
-	mu.Lock()
-	commandCache[cmd] = path
-	mu.Unlock()
-	time.AfterFunc(cacheExpiration, func() {
-		mu.Lock()
-		delete(commandCache, cmd)
-		mu.Unlock()
-	})
+// runPipelineBuiltin runs a builtin stage of a pipeline, writing to output
+// when it is the last stage. Closing its pipe ends afterwards gives the next
+// stage EOF and the previous one a write error, just as when an external
+// command exits.
+func runPipelineBuiltin(ctx context.Context, stage *pipelineStage, output io.Writer, running *sync.WaitGroup) {
+	defer running.Done()
+	defer closeFiles(stage.files())
+	writer := &pipeStageWriter{Writer: output, ctx: ctx}
+	if stage.stdout != nil {
+		writer.Writer = stage.stdout
+	}
+	if stage.stdin != nil {
+		writer.stdin = stage.stdin
+	}
+	stage.builtin(stage.args[1:], writer)
 }
 
-func getCachedCommandPath(cmd string) (string, bool) {
-	mu.Lock()
-	defer mu.Unlock()
-	path, found := commandCache[cmd]
-	return path, found
+// pipeStageWriter is the writer handed to a builtin running as part of a
+// pipeline. It carries the stage's standard input and the pipeline's
+// context along with its output.
+type pipeStageWriter struct {
+	io.Writer
+	stdin io.Reader
+	ctx   context.Context
 }
 
-func loadEnvVars(filepath string) {
-	file, err := os.Open(filepath)
-	if err != nil {
-		return
+// builtinContext returns the context of the job a builtin writing to writer
+// runs in, which is done once the job is interrupted or killed. A builtin
+// run directly by handleCommand cannot be interrupted.
+func builtinContext(writer io.Writer) context.Context {
+	var ctx context.Context
+	switch w := writer.(type) {
+	case *builtinJobWriter:
+		ctx = w.ctx
+	case *pipeStageWriter:
+		ctx = w.ctx
 	}
-	defer file.Close()
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) == 2 {
-			mu.Lock()
-			envVars[parts[0]] = parts[1]
-			mu.Unlock()
-			os.Setenv(parts[0], parts[1])
-		}
+// builtinStdin returns the input piped into a builtin writing to writer, or
+// nil when the builtin is not reading from a pipeline.
+func builtinStdin(writer io.Writer) io.Reader {
+	if stage, ok := writer.(*pipeStageWriter); ok && stage.stdin != nil {
+		return stage.stdin
 	}
+	return nil
 }
 
-func saveEnvVars(filepath string) {
-	file, err := os.Create(filepath)
-	if err != nil {
-		fmt.Printf("Error saving environment variables: %v\n", err)
-		return
+// inPipeline reports whether a builtin writing to writer is running as part
+// of a pipeline.
+func inPipeline(writer io.Writer) bool {
+	_, ok := writer.(*pipeStageWriter)
+	return ok
+}
+
+// closeFiles closes every file in files, ignoring errors.
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
 	}
-	defer file.Close()
+}
 
-	mu.Lock()
-	for k, v := range envVars {
-		fmt.Fprintf(file, "%s=%s\n", k, v)
+func executeRedirectedCommand(redirect redirection, writer io.Writer) {
+	cmdArgs := redirect.args
+	files, ok := openRedirections(redirect, writer)
+	if !ok {
+		return
 	}
-	mu.Unlock()
+	// The process has its own copies of the files once it has started
+	defer files.close()
+
+	cmd := newCommand(cmdArgs[0], cmdArgs[1:]...)
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	files.redirect(cmd, redirect.stderrToStdout)
+	startForegroundJob(cmd, strings.Join(cmdArgs, " "), writer)
 }
 
-func substituteCommand(cmdLine string) string {
-	for {
-		start := strings.Index(cmdLine, "$(")
-		if start == -1 {
-			break
-		}
-		end := strings.Index(cmdLine[start:], ")")
-		if end == -1 {
-			break
-		}
-		end += start
-		subCmd := cmdLine[start+2 : end]
-		output, err := exec.Command("/bin/sh", "-c", subCmd).Output()
-		if err == nil {
-			cmdLine = cmdLine[:start] + strings.TrimSpace(string(output)) + cmdLine[end+1:]
-		}
+// executeRedirectedBuiltin runs a builtin with its output going to the file
+// redirect names. A redirected input is read the way a builtin reads the
+// output of a pipeline. Builtins report errors on the same writer as their
+// output, so 2> only creates its file.
+func executeRedirectedBuiltin(redirect redirection, builtinFunc func([]string, io.Writer), writer io.Writer) {
+	files, ok := openRedirections(redirect, writer)
+	if !ok {
+		return
 	}
-	return cmdLine
+	defer files.close()
+
+	// A builtin running as a job keeps the job's context, so that it can
+	// still be cancelled
+	ctx := builtinContext(writer)
+	output := writer
+	if files.stdout != nil {
+		output = &builtinJobWriter{Writer: files.stdout, ctx: ctx}
+	}
+	if files.stdin != nil {
+		output = &pipeStageWriter{Writer: output, stdin: files.stdin, ctx: ctx}
+	}
+	builtinFunc(redirect.args[1:], output)
 }
 
-type AutoCompleter struct{}
+// redirectedFiles are the files opened for the redirections of a command,
+// nil for the streams that are not redirected.
+type redirectedFiles struct {
+	stdin, stdout, stderr *os.File
+}
 
-func (a *AutoCompleter) Do(line []rune, pos int) ([][]rune, int) {
-	var suggestions [][]rune
-	prefix := string(line[:pos])
-	for cmd := range builtins {
-		if strings.HasPrefix(cmd, prefix) {
-			suggestions = append(suggestions, []rune(cmd))
+// openRedirections opens the files named by redirect, reporting a failure
+// on writer.
+func openRedirections(redirect redirection, writer io.Writer) (redirectedFiles, bool) {
+	var files redirectedFiles
+	var err error
+	if redirect.stdout != "" {
+		files.stdout, err = openRedirectTarget(redirect.stdout, redirect.appendStdout)
+		if err != nil {
+			setExitStatus(1)
+			fmt.Fprintf(writer, "Error creating file %s: %v\n", redirect.stdout, err)
+			return files, false
 		}
 	}
-	pathEnv := os.Getenv("PATH")
-	paths := strings.Split(pathEnv, string(os.PathListSeparator))
-	for _, path := range paths {
-		files, err := os.ReadDir(path)
+	if redirect.stderr != "" {
+		files.stderr, err = openRedirectTarget(redirect.stderr, redirect.appendStderr)
 		if err != nil {
-			continue
+			files.close()
+			setExitStatus(1)
+			fmt.Fprintf(writer, "Error creating file %s: %v\n", redirect.stderr, err)
+			return redirectedFiles{}, false
 		}
-		for _, file := range files {
-			if strings.HasPrefix(file.Name(), prefix) {
-				suggestions = append(suggestions, []rune(file.Name()))
-			}
+	}
+	if redirect.stdin != "" {
+		files.stdin, err = os.Open(nullDevice(redirect.stdin))
+		if err != nil {
+			files.close()
+			setExitStatus(1)
+			fmt.Fprintf(writer, "Error opening file %s: %v\n", redirect.stdin, err)
+			return redirectedFiles{}, false
 		}
 	}
-	return suggestions, len(prefix)
+	return files, true
 }
 
-func executePipedCommands(cmdLine string) {
-	commands := strings.Split(cmdLine, "|")
-	var cmds []*exec.Cmd
-
-	for _, cmdStr := range commands {
-		cmdArgs := strings.Fields(strings.TrimSpace(cmdStr))
-		cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
-		cmds = append(cmds, cmd)
+// redirect points the streams of cmd at the files that were opened for them.
+func (files redirectedFiles) redirect(cmd *exec.Cmd, stderrToStdout bool) {
+	if files.stdout != nil {
+		cmd.Stdout = files.stdout
 	}
-
-	var lastStdout io.ReadCloser
-	for i, cmd := range cmds {
-		if i != 0 {
-			cmd.Stdin = lastStdout
-		}
-		if i != len(cmds)-1 {
-			stdout, _ := cmd.StdoutPipe()
-			lastStdout = stdout
-		} else {
-			cmd.Stdout = io.MultiWriter(os.Stdout, textView)
-		}
-		cmd.Stderr = io.MultiWriter(os.Stderr, textView)
-		cmd.Start()
+	if files.stderr != nil {
+		cmd.Stderr = files.stderr
 	}
-	for _, cmd := range cmds {
-		cmd.Wait()
+	if stderrToStdout {
+		cmd.Stderr = cmd.Stdout
+	}
+	if files.stdin != nil {
+		cmd.Stdin = files.stdin
 	}
 }
 
-func executeRedirectedCommand(cmdLine string, writer io.Writer) {
-	var cmdArgs []string
-	var redirectOut, redirectIn string
-	redirectOutIndex := strings.Index(cmdLine, ">")
-	redirectInIndex := strings.Index(cmdLine, "<")
-	if redirectOutIndex != -1 {
-		cmdArgs = strings.Fields(strings.TrimSpace(cmdLine[:redirectOutIndex]))
-		redirectOut = strings.TrimSpace(cmdLine[redirectOutIndex+1:])
-	} else if redirectInIndex != -1 {
-		cmdArgs = strings.Fields(strings.TrimSpace(cmdLine[:redirectInIndex]))
-		redirectIn = strings.TrimSpace(cmdLine[redirectInIndex+1:])
-	} else {
-		cmdArgs = strings.Fields(cmdLine)
+// close closes the files that were opened.
+func (files redirectedFiles) close() {
+	for _, f := range []*os.File{files.stdin, files.stdout, files.stderr} {
+		if f != nil {
+			f.Close()
+		}
 	}
+}
 
-	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
-	if redirectOut != "" {
-		outFile, err := os.Create(redirectOut)
-		if err != nil {
-			fmt.Fprintf(writer, "Error creating file %s: %v\n", redirectOut, err)
-			return
+// redirection is a command line with its redirections taken out.
+type redirection struct {
+	args                       []string
+	stdin, stdout, stderr      string
+	appendStdout, appendStderr bool
+	// stderrToStdout sends standard error wherever stdout goes
+	stderrToStdout bool
+}
+
+// parseRedirection splits the redirections <, >, >>, 2>, 2>> and 2>&1 off
+// a command line. The spaces around them are optional, so "a>>b" appends
+// the output of a to b. As in other shells they apply from left to right:
+// "> file 2>&1" sends both streams to file, while "2>&1 > file" leaves
+// standard error where stdout was before.
+func parseRedirection(cmdLine string) (redirection, error) {
+	var redirect redirection
+	var command strings.Builder
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' }
+	var quote byte
+	for i := 0; i < len(cmdLine); i++ {
+		c := cmdLine[i]
+		special := false
+		switch {
+		case c == '\\' && quote != '\'' && i+1 < len(cmdLine):
+			// Keep the escape for tokenize, along with what it escapes
+			command.WriteByte(c)
+			i++
+			c = cmdLine[i]
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		default:
+			special = c == '<' || c == '>'
 		}
-		defer outFile.Close()
-		cmd.Stdout = outFile
-	}
-	if redirectIn != "" {
-		inFile, err := os.Open(redirectIn)
+		if !special {
+			command.WriteByte(c)
+			continue
+		}
+		operator := string(c)
+		// A 2 standing alone in front of > names standard error
+		stderr := c == '>' && i > 0 && cmdLine[i-1] == '2' && (i == 1 || isSpace(cmdLine[i-2]))
+		if stderr {
+			text := command.String()
+			command.Reset()
+			command.WriteString(text[:len(text)-1])
+			operator = "2>"
+		}
+		if stderr && strings.HasPrefix(cmdLine[i+1:], "&1") {
+			i += 2
+			command.WriteByte(' ')
+			// Before stdout is redirected, this puts stderr back on the
+			// writer both start out on
+			redirect.stderr = ""
+			redirect.stderrToStdout = redirect.stdout != ""
+			continue
+		}
+		appending := c == '>' && i+1 < len(cmdLine) && cmdLine[i+1] == '>'
+		if appending {
+			i++
+			operator += ">"
+		}
+
+		start := i + 1
+		for start < len(cmdLine) && isSpace(cmdLine[start]) {
+			start++
+		}
+		end := start
+		for end < len(cmdLine) && (quote != 0 || !isSpace(cmdLine[end]) && cmdLine[end] != '<' && cmdLine[end] != '>') {
+			switch {
+			case cmdLine[end] == '\\' && quote != '\'' && end+1 < len(cmdLine):
+				end++
+			case quote != 0:
+				if cmdLine[end] == quote {
+					quote = 0
+				}
+			case cmdLine[end] == '\'' || cmdLine[end] == '"':
+				quote = cmdLine[end]
+			}
+			end++
+		}
+		words, err := tokenize(cmdLine[start:end])
 		if err != nil {
-			fmt.Fprintf(writer, "Error opening file %s: %v\n", redirectIn, err)
-			return
+			return redirect, err
+		}
+		if len(words) != 1 {
+			return redirect, fmt.Errorf("syntax error near unexpected token '%s'", operator)
+		}
+		target := words[0]
+		i = end - 1
+		command.WriteByte(' ')
+
+		switch {
+		case c == '<':
+			redirect.stdin = target
+		case stderr:
+			redirect.stderr, redirect.appendStderr = target, appending
+			redirect.stderrToStdout = false
+		default:
+			if redirect.stderrToStdout {
+				// Standard error stays with the file stdout is leaving
+				redirect.stderr, redirect.appendStderr = redirect.stdout, redirect.appendStdout
+				redirect.stderrToStdout = false
+			}
+			redirect.stdout, redirect.appendStdout = target, appending
 		}
-		defer inFile.Close()
-		cmd.Stdin = inFile
 	}
-	cmd.Stderr = writer
-	err := cmd.Run()
+	args, err := tokenize(command.String())
 	if err != nil {
-		fmt.Fprintf(writer, "%s: %v\n", cmdArgs[0], err)
+		return redirect, err
+	}
+	redirect.args = args
+	if len(redirect.args) == 0 {
+		return redirect, errors.New("syntax error: missing command before redirection")
+	}
+	return redirect, nil
+}
+
+// openRedirectTarget opens the file output is redirected to, appending to
+// it or truncating it.
+func openRedirectTarget(path string, appending bool) (*os.File, error) {
+	path = nullDevice(path)
+	if appending {
+		return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	}
+	return os.Create(path)
+}
+
+// nullDevice maps the Unix null device to the platform's equivalent so that
+// redirections to /dev/null also work on Windows.
+func nullDevice(path string) string {
+	if path == "/dev/null" {
+		return os.DevNull
+	}
+	return path
 }
 
 func loadAliasesAndEnvVars(filepath string) {
@@ -869,7 +6978,9 @@ func loadAliasesAndEnvVars(filepath string) {
 		if strings.HasPrefix(line, "alias ") {
 			parts := strings.SplitN(line[6:], "=", 2)
 			if len(parts) == 2 {
+				mu.Lock()
 				aliases[parts[0]] = strings.Trim(parts[1], "'\"")
+				mu.Unlock()
 			}
 		} else {
 			parts := strings.SplitN(line, "=", 2)
@@ -901,13 +7012,12 @@ func saveAliasesAndEnvVars(filepath string) {
 	mu.Unlock()
 }
 
-// sendSignalContinue is a placeholder for the SIGCONT signal handling in Windows.
-func sendSignalContinue() error {
-	return errors.New("SIGCONT not supported on Windows")
-}
-
-// userHomeDir gets the user's home directory.
+// userHomeDir gets the user's home directory. As in other shells $HOME
+// comes first, so it can point somewhere else.
 func userHomeDir() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return home
+	}
 	user, err := user.Current()
 	if err != nil {
 		return ""
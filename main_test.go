@@ -0,0 +1,1064 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// setupTestUI gives a test the views commands write to and an empty shell
+// state, and runs it in a temporary working directory with a temporary
+// home directory.
+func setupTestUI(t *testing.T) string {
+	t.Helper()
+	textView = tview.NewTextView()
+	inputView = &inputLine{tview.NewTextView()}
+	statusBar = tview.NewTextView()
+	mu.Lock()
+	jobs = nil
+	foregroundJob = nil
+	history = nil
+	historyTimes = nil
+	mu.Unlock()
+	pendingCommands = nil
+	setExitStatus(0)
+	t.Setenv("HOME", t.TempDir())
+
+	dir := t.TempDir()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+	return dir
+}
+
+// waitForJob fails the test if job does not finish in time.
+func waitForJob(t *testing.T, job *Job) {
+	t.Helper()
+	select {
+	case <-job.done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("job %q did not finish", job.Line)
+	}
+}
+
+// writeTestFile creates name in dir holding data.
+func writeTestFile(t *testing.T, dir, name, data string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runLineAndWait runs line as if typed at the prompt and waits for the
+// foreground jobs it starts, doing the UI goroutine's part as they finish.
+// It returns the text written to the view.
+func runLineAndWait(t *testing.T, line string) string {
+	t.Helper()
+	runLine(line)
+	for {
+		mu.Lock()
+		job := foregroundJob
+		mu.Unlock()
+		if job != nil {
+			waitForJob(t, job)
+		}
+		if len(pendingCommands) == 0 {
+			break
+		}
+		runPendingCommands()
+	}
+	return textView.GetText(true)
+}
+
+func TestPipelineSequencing(t *testing.T) {
+	setupTestUI(t)
+
+	out := runLineAndWait(t, "printf 'first\\n' | cat; echo second")
+	first, second := strings.Index(out, "first"), strings.Index(out, "second")
+	if first < 0 || second < first {
+		t.Errorf("output = %q, want the pipeline output before the next command", out)
+	}
+
+	textView.Clear()
+	out = runLineAndWait(t, "sh -c 'exit 3' | sh -c 'exit 5'; echo status $?")
+	if !strings.Contains(out, "status 5") {
+		t.Errorf("output = %q, want the pipeline's exit status", out)
+	}
+}
+
+func TestInterruptibleBuiltinSequencing(t *testing.T) {
+	dir := setupTestUI(t)
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("alpha\nbeta\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := runLineAndWait(t, "head -n 1 notes.txt; echo after")
+	first, after := strings.Index(out, "alpha"), strings.Index(out, "after")
+	if first < 0 || after < first {
+		t.Errorf("output = %q, want head's output before the next command", out)
+	}
+
+	textView.Clear()
+	out = runLineAndWait(t, "grep gamma notes.txt; echo status $?")
+	if !strings.Contains(out, "status 1") {
+		t.Errorf("output = %q, want grep's exit status", out)
+	}
+}
+
+func TestBackgroundJobsRace(t *testing.T) {
+	setupTestUI(t)
+
+	// Jobs finishing in the background update the job table and the exit
+	// status while more jobs are started; go test -race checks the access
+	const count = 50
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < count; i++ {
+			runCommand("sleep 0 &")
+			exitStatus()
+		}
+	}()
+	for i := 0; i < count; i++ {
+		setExitStatus(exitStatus())
+		runningJobCount()
+	}
+	<-done
+
+	mu.Lock()
+	started := append([]*Job(nil), jobs...)
+	mu.Unlock()
+	if len(started) != count {
+		t.Fatalf("started %d jobs, want %d", len(started), count)
+	}
+	seen := make(map[int]bool)
+	for _, job := range started {
+		waitForJob(t, job)
+		if seen[job.ID] {
+			t.Errorf("job ID %d used twice", job.ID)
+		}
+		seen[job.ID] = true
+	}
+}
+
+func TestFindExitStatus(t *testing.T) {
+	dir := setupTestUI(t)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	findCommand([]string{".", "-name", "*.txt"}, &out)
+	if exitStatus() != 0 || !strings.Contains(out.String(), "a.txt") {
+		t.Errorf("find . -name *.txt: status %d, output %q", exitStatus(), out.String())
+	}
+
+	out.Reset()
+	findCommand([]string{"missing"}, &out)
+	if exitStatus() != 1 {
+		t.Errorf("find missing: status %d, want 1", exitStatus())
+	}
+
+	// Quotes are removed by the tokenizer, so a quote left in the
+	// pattern is part of the name
+	setExitStatus(0)
+	out.Reset()
+	findCommand([]string{".", "-name", "'a.txt'"}, &out)
+	if strings.Contains(out.String(), "a.txt") {
+		t.Errorf("find -name 'a.txt' with literal quotes matched: %q", out.String())
+	}
+}
+
+func TestDuExitStatus(t *testing.T) {
+	dir := setupTestUI(t)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	duCommand([]string{"-s", "."}, &out)
+	if exitStatus() != 0 || !strings.HasPrefix(out.String(), "5\t") {
+		t.Errorf("du -s .: status %d, output %q", exitStatus(), out.String())
+	}
+
+	duCommand([]string{"missing"}, &out)
+	if exitStatus() != 1 {
+		t.Errorf("du missing: status %d, want 1", exitStatus())
+	}
+
+	setExitStatus(0)
+	duCommand([]string{"-x"}, &out)
+	if exitStatus() != 1 {
+		t.Errorf("du -x: status %d, want 1", exitStatus())
+	}
+}
+
+func TestCompletePatterns(t *testing.T) {
+	setupTestUI(t)
+	t.Cleanup(func() { delete(completionSpecs, "testcmd") })
+
+	var out bytes.Buffer
+	completeCommand([]string{"-G", "*.go", "-X", "*_test.go", "testcmd"}, &out)
+	spec := completionSpecs["testcmd"]
+	if spec.include != "*.go" || spec.exclude != "*_test.go" {
+		t.Errorf("spec = %+v, want the patterns as given", spec)
+	}
+
+	// The tokenizer has already removed quoting, so quotes that reach the
+	// builtin are part of the pattern
+	completeCommand([]string{"-G", "'*.go'", "testcmd"}, &out)
+	if spec := completionSpecs["testcmd"]; spec.include != "'*.go'" {
+		t.Errorf("include = %q, want the quotes kept", spec.include)
+	}
+}
+
+func TestCheckPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{"*.go", true},
+		{"[abc]*", true},
+		{"[*]", true},
+		{"[", false},
+		{"*.go[", false},
+		// A literal that fails to match must not hide a later error
+		{"a*b[", false},
+		{"x*y*z[a-", false},
+	}
+	for _, test := range tests {
+		if err := checkPattern(test.pattern); (err == nil) != test.valid {
+			t.Errorf("checkPattern(%q) = %v, want valid %v", test.pattern, err, test.valid)
+		}
+	}
+}
+
+func TestCompleteWords(t *testing.T) {
+	setupTestUI(t)
+	t.Cleanup(func() { delete(completionSpecs, "testcmd") })
+
+	var out bytes.Buffer
+	completeCommand([]string{"-W", "start stop", "testcmd"}, &out)
+	if words := completionSpecs["testcmd"].words; len(words) != 2 || words[0] != "start" || words[1] != "stop" {
+		t.Errorf("words = %q, want [start stop]", words)
+	}
+
+	completeCommand([]string{"-X", "a*b[", "testcmd"}, &out)
+	if exitStatus() != 1 || !strings.Contains(out.String(), "invalid pattern") {
+		t.Errorf("complete -X 'a*b[': status %d, output %q", exitStatus(), out.String())
+	}
+}
+
+func TestShellReset(t *testing.T) {
+	setupTestUI(t)
+	t.Cleanup(func() {
+		for _, option := range shellOptions {
+			resetShellOption(option)
+		}
+	})
+
+	// Every default must be a value that setting the option accepts
+	for _, option := range shellOptions {
+		value, ok := shellDefaults[option]
+		if !ok {
+			t.Errorf("%s has no default", option)
+			continue
+		}
+		var out bytes.Buffer
+		handleShellCustomization([]string{option, value}, &out)
+		if strings.Contains(out.String(), "Invalid") || strings.Contains(out.String(), "Unknown") {
+			t.Errorf("shell %s %q: %s", option, value, out.String())
+		}
+	}
+
+	var out bytes.Buffer
+	handleShellCustomization([]string{"prompt-style", "%d >"}, &out)
+	handleShellCustomization([]string{"text-color", "red"}, &out)
+	handleShellCustomization([]string{"tabwidth", "4"}, &out)
+	handleShellCustomization([]string{"reset", "all"}, &out)
+	if shellPromptStyle != "default" || shellTextColor != "white" || shellTabWidth != 8 {
+		t.Errorf("after reset all: prompt-style %q, text-color %q, tabwidth %d", shellPromptStyle, shellTextColor, shellTabWidth)
+	}
+
+	handleShellCustomization([]string{"long-cmd-threshold", "10"}, &out)
+	handleShellCustomization([]string{"reset", "long-cmd-threshold"}, &out)
+	if shellLongCmdThreshold != 3*time.Second {
+		t.Errorf("after reset: long-cmd-threshold %s, want 3s", shellLongCmdThreshold)
+	}
+}
+
+func TestCommandOutputVariables(t *testing.T) {
+	setupTestUI(t)
+	mu.Lock()
+	shellVars["DYSHELL_LOCAL"] = "a; echo injected"
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		delete(shellVars, "DYSHELL_LOCAL")
+		mu.Unlock()
+	})
+	t.Setenv("DYSHELL_EXPORTED", "exported")
+
+	// The substitution itself sees shell variables, as data
+	if got := commandOutput(`printf '%s' "$DYSHELL_LOCAL"`); got != "a; echo injected" {
+		t.Errorf("commandOutput = %q, want the variable's value", got)
+	}
+	if got := commandOutput(`echo $DYSHELL_LOCAL`); got != "a; echo injected" {
+		t.Errorf("commandOutput = %q, want the value unquoted but not run", got)
+	}
+	if got := commandOutput(`echo '$DYSHELL_LOCAL'`); got != "$DYSHELL_LOCAL" {
+		t.Errorf("commandOutput = %q, want single quotes to stop expansion", got)
+	}
+	// Commands it runs only see exported variables
+	if got := commandOutput(`sh -c 'echo $DYSHELL_LOCAL'`); got != "" {
+		t.Errorf("external command saw the local variable: %q", got)
+	}
+	if got := commandOutput(`sh -c 'echo $DYSHELL_EXPORTED'`); got != "exported" {
+		t.Errorf("external command saw %q, want the exported variable", got)
+	}
+}
+
+func TestStateBuiltinsInBackground(t *testing.T) {
+	dir := setupTestUI(t)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	out := runLineAndWait(t, "cd sub &")
+	if exitStatus() != 1 || !strings.Contains(out, "cannot run in the background") {
+		t.Errorf("cd sub &: status %d, output %q", exitStatus(), out)
+	}
+	if wd, _ := os.Getwd(); filepath.Base(wd) == "sub" {
+		t.Error("cd & changed the working directory")
+	}
+	mu.Lock()
+	count := len(jobs)
+	mu.Unlock()
+	if count != 0 {
+		t.Errorf("cd & started %d jobs", count)
+	}
+}
+
+func TestBackgroundRedirection(t *testing.T) {
+	dir := setupTestUI(t)
+	if err := os.WriteFile(filepath.Join(dir, "in.txt"), []byte("one\ntwo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runLineAndWait(t, "echo builtin > builtin.txt &")
+	runLineAndWait(t, "wc -l < in.txt > count.txt &")
+	runLineAndWait(t, "sh -c 'echo external; echo oops >&2' > external.txt 2> errors.txt &")
+	mu.Lock()
+	started := append([]*Job(nil), jobs...)
+	mu.Unlock()
+	if len(started) != 3 {
+		t.Fatalf("started %d jobs, want 3", len(started))
+	}
+	for _, job := range started {
+		waitForJob(t, job)
+	}
+
+	for name, want := range map[string]string{
+		"builtin.txt":  "builtin\n",
+		"count.txt":    "2\n",
+		"external.txt": "external\n",
+		"errors.txt":   "oops\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if strings.TrimLeft(string(data), " ") != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+	if strings.Contains(textView.GetText(true), "external") {
+		t.Error("redirected output of a background job reached the view")
+	}
+}
+
+func TestPipelineLargeOutput(t *testing.T) {
+	setupTestUI(t)
+
+	// The first stage writes far more than a pipe buffer holds while the
+	// second is slow to start reading, so the stages must run concurrently
+	out := runLineAndWait(t, "seq 1 200000 | sh -c 'sleep 0.2; cat' | wc -l")
+	if !strings.Contains(out, "200000") {
+		t.Errorf("output = %q, want 200000 lines counted", out)
+	}
+}
+
+func TestPipelineDescriptorsClosed(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("no /proc/self/fd")
+	}
+	setupTestUI(t)
+	countFDs := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	runLineAndWait(t, "true | true")
+	before := countFDs()
+	for i := 0; i < 300; i++ {
+		runLineAndWait(t, "echo x | cat | wc -c")
+		runLineAndWait(t, "missing-command-xyz | cat")
+	}
+	// Allow for descriptors the runtime opens for itself
+	if after := countFDs(); after > before+5 {
+		t.Errorf("open descriptors grew from %d to %d", before, after)
+	}
+}
+
+func TestRedirectAppend(t *testing.T) {
+	dir := setupTestUI(t)
+	path := filepath.Join(dir, "log.txt")
+
+	for _, line := range []string{"first", "second"} {
+		f, err := openRedirectTarget(path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(line + "\n")
+		f.Close()
+	}
+	redirect, err := parseRedirection("echo third >> log.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	executeRedirectedCommand(redirect, newDisplayWriter())
+	waitForForeground(t)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first\nsecond\nthird\n" {
+		t.Errorf("log.txt = %q, want every write appended", data)
+	}
+}
+
+func TestRedirectStderr(t *testing.T) {
+	dir := setupTestUI(t)
+
+	out := runLineAndWait(t, "sh -c 'echo out; echo err >&2' 2> err.txt")
+	runLineAndWait(t, "sh -c 'echo again >&2' 2>> err.txt")
+	data, err := os.ReadFile(filepath.Join(dir, "err.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "err\nagain\n" {
+		t.Errorf("err.txt = %q, want only the error output", data)
+	}
+	if !strings.Contains(out, "out") || strings.Contains(out, "err") {
+		t.Errorf("output = %q, want only the standard output", out)
+	}
+}
+
+func TestRedirectStderrToStdoutOrder(t *testing.T) {
+	dir := setupTestUI(t)
+	script := "sh -c 'echo out; echo err >&2'"
+
+	// After stdout is redirected, 2>&1 sends stderr to the same file
+	out := runLineAndWait(t, script+" > both.txt 2>&1")
+	if data, _ := os.ReadFile(filepath.Join(dir, "both.txt")); string(data) != "out\nerr\n" {
+		t.Errorf("both.txt = %q, want both streams", data)
+	}
+	if strings.Contains(out, "err") {
+		t.Errorf("output = %q, want nothing shown", out)
+	}
+
+	// Before it, stderr stays where stdout was
+	textView.Clear()
+	out = runLineAndWait(t, script+" 2>&1 > stdout.txt")
+	if data, _ := os.ReadFile(filepath.Join(dir, "stdout.txt")); string(data) != "out\n" {
+		t.Errorf("stdout.txt = %q, want only the standard output", data)
+	}
+	if !strings.Contains(out, "err") {
+		t.Errorf("output = %q, want the error output shown", out)
+	}
+
+	redirect, err := parseRedirection("cmd 2>&1 > a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redirect.stdout != "a.txt" || redirect.stderrToStdout || redirect.stderr != "" {
+		t.Errorf("parseRedirection = %+v", redirect)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{line: "ls -la  /tmp", want: []string{"ls", "-la", "/tmp"}},
+		{line: `echo 'a  b' "c d"`, want: []string{"echo", "a  b", "c d"}},
+		{line: `echo "it's" 'say "hi"'`, want: []string{"echo", "it's", `say "hi"`}},
+		{line: `echo --name="a b"`, want: []string{"echo", "--name=a b"}},
+		{line: `echo "" ''`, want: []string{"echo", "", ""}},
+		{line: `echo a\ b \$HOME`, want: []string{"echo", "a b", "$HOME"}},
+		{line: `echo "a \"quoted\" \$x"`, want: []string{"echo", `a "quoted" $x`}},
+		{line: `echo '\n'`, want: []string{"echo", `\n`}},
+		{line: `cd C:\Users`, want: []string{"cd", `C:\Users`}},
+		{line: "echo a \\\nb", want: []string{"echo", "a", "b"}},
+		{line: "", want: nil},
+		{line: `echo 'open`, wantErr: true},
+		{line: `echo "open`, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := tokenize(test.line)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("tokenize(%q) = %q, want an error", test.line, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("tokenize(%q): %v", test.line, err)
+			continue
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestSingleQuotesStopExpansion(t *testing.T) {
+	setupTestUI(t)
+	t.Setenv("HOME", "/home/tester")
+
+	out := runLineAndWait(t, `echo '$HOME' "$HOME" $HOME`)
+	if !strings.Contains(out, "$HOME /home/tester /home/tester") {
+		t.Errorf("output = %q, want single quotes kept literal", out)
+	}
+	if got := expandWords(`'$HOME' "$HOME"`); got != `'$HOME' "/home/tester"` {
+		t.Errorf("expandWords = %q", got)
+	}
+}
+
+func TestGrep(t *testing.T) {
+	dir := setupTestUI(t)
+	writeTestFile(t, dir, "notes.txt", "Error: disk full\nok\nerror code 42\na.b\naxb\n")
+
+	tests := []struct {
+		args   []string
+		want   string
+		status int
+	}{
+		{[]string{"error", "notes.txt"}, "error code 42\n", 0},
+		{[]string{"-i", "error", "notes.txt"}, "Error: disk full\nerror code 42\n", 0},
+		{[]string{"-n", "ok", "notes.txt"}, "2:ok\n", 0},
+		{[]string{"-in", "^error", "notes.txt"}, "1:Error: disk full\n3:error code 42\n", 0},
+		{[]string{"[0-9]+$", "notes.txt"}, "error code 42\n", 0},
+		{[]string{`a\.b`, "notes.txt"}, "a.b\n", 0},
+		{[]string{"a.b", "notes.txt"}, "a.b\naxb\n", 0},
+		{[]string{"missing", "notes.txt"}, "", 1},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		setExitStatus(0)
+		grepCommand(test.args, &out)
+		if out.String() != test.want {
+			t.Errorf("grep %q = %q, want %q", test.args, out.String(), test.want)
+		}
+		if exitStatus() != test.status {
+			t.Errorf("grep %q: status %d, want %d", test.args, exitStatus(), test.status)
+		}
+	}
+
+	var out bytes.Buffer
+	grepCommand([]string{"(", "notes.txt"}, &out)
+	if exitStatus() != 2 || !strings.HasPrefix(out.String(), "grep: invalid pattern") {
+		t.Errorf("grep '(': status %d, output %q", exitStatus(), out.String())
+	}
+}
+
+// pipedInput makes a builtin writing to out read input as the output of an
+// earlier pipeline stage.
+func pipedInput(out io.Writer, input string) io.Writer {
+	return &pipeStageWriter{Writer: out, stdin: strings.NewReader(input), ctx: context.Background()}
+}
+
+func TestWc(t *testing.T) {
+	dir := setupTestUI(t)
+	writeTestFile(t, dir, "a.txt", "one two\nthree\n")
+	writeTestFile(t, dir, "b.txt", strings.Repeat("word ", 200)+"\n")
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-l", "a.txt"}, "2 a.txt\n"},
+		{[]string{"-w", "a.txt"}, "3 a.txt\n"},
+		{[]string{"-c", "a.txt"}, "14 a.txt\n"},
+		{[]string{"a.txt"}, " 2  3 14 a.txt\n"},
+		// Every column is as wide as the largest count shown, here the
+		// total number of words
+		{[]string{"-lw", "a.txt", "b.txt"}, "  2   3 a.txt\n  1 200 b.txt\n  3 203 total\n"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		wcCommand(test.args, &out)
+		if out.String() != test.want {
+			t.Errorf("wc %q = %q, want %q", test.args, out.String(), test.want)
+		}
+	}
+
+	var out bytes.Buffer
+	wcCommand([]string{"-l"}, pipedInput(&out, "x\ny\nz\n"))
+	if out.String() != "3\n" {
+		t.Errorf("piped wc -l = %q, want %q", out.String(), "3\n")
+	}
+}
+
+func TestHead(t *testing.T) {
+	dir := setupTestUI(t)
+	writeTestFile(t, dir, "short.txt", "one\ntwo\nthree")
+
+	var out bytes.Buffer
+	headCommand([]string{"-n", "5", "short.txt"}, &out)
+	if out.String() != "one\ntwo\nthree" {
+		t.Errorf("head -n 5 of a shorter file = %q, want the whole file", out.String())
+	}
+
+	out.Reset()
+	headCommand([]string{"-n2"}, pipedInput(&out, "a\nb\nc\n"))
+	if out.String() != "a\nb\n" {
+		t.Errorf("piped head -n2 = %q, want %q", out.String(), "a\nb\n")
+	}
+
+	// head stops reading once it has its lines, which ends the pipeline
+	textView.Clear()
+	got := runLineAndWait(t, "yes | head -n 3")
+	if strings.Count(got, "y\n") != 3 {
+		t.Errorf("yes | head -n 3 = %q, want three lines", got)
+	}
+
+	// On its own, yes runs as the foreground job until Ctrl-C
+	textView.Clear()
+	runLine("yes")
+	mu.Lock()
+	job := foregroundJob
+	mu.Unlock()
+	if job == nil {
+		t.Fatal("yes did not run as the foreground job")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !interruptForegroundJob() {
+		t.Fatal("yes could not be interrupted")
+	}
+	waitForJob(t, job)
+	runPendingCommands()
+	if !strings.HasPrefix(textView.GetText(true), "y\ny\n") {
+		t.Errorf("yes printed %.20q, want lines of y", textView.GetText(true))
+	}
+}
+
+// lineSource produces count copies of line without holding them in memory.
+// When it runs out it records how much heap is still live, which is then
+// what its reader holds on to.
+type lineSource struct {
+	line  string
+	count int
+	heap  uint64
+}
+
+func (s *lineSource) Read(p []byte) (int, error) {
+	if s.count == 0 {
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		s.heap = stats.HeapAlloc
+		return 0, io.EOF
+	}
+	n := 0
+	for s.count > 0 && len(p)-n >= len(s.line) {
+		n += copy(p[n:], s.line)
+		s.count--
+	}
+	return n, nil
+}
+
+func TestTail(t *testing.T) {
+	dir := setupTestUI(t)
+	writeTestFile(t, dir, "short.txt", "one\ntwo\n")
+
+	var out bytes.Buffer
+	tailCommand([]string{"-n", "5", "short.txt"}, &out)
+	if out.String() != "one\ntwo\n" {
+		t.Errorf("tail -n 5 of a shorter file = %q, want the whole file", out.String())
+	}
+
+	out.Reset()
+	tailCommand([]string{"-n", "0", "short.txt"}, &out)
+	if out.String() != "" {
+		t.Errorf("tail -n 0 = %q, want nothing", out.String())
+	}
+
+	// 100MB of input, of which only the last two lines are kept
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	source := &lineSource{line: strings.Repeat("x", 99) + "\n", count: 1000000}
+	out.Reset()
+	tailCommand([]string{"-n", "2"}, &pipeStageWriter{Writer: &out, stdin: source, ctx: context.Background()})
+	if want := strings.Repeat(source.line, 2); out.String() != want {
+		t.Errorf("tail -n 2 of large input printed %d bytes, want %d", out.Len(), len(want))
+	}
+	if grown := int64(source.heap) - int64(before.HeapAlloc); grown > 8<<20 {
+		t.Errorf("tail held %d bytes of a large input in memory", grown)
+	}
+}
+
+func TestExternalExitStatus(t *testing.T) {
+	setupTestUI(t)
+
+	tests := []struct {
+		line   string
+		status int
+	}{
+		{"true", 0},
+		{"false", 1},
+		{"sh -c 'exit 7'", 7},
+		{"missing-command-xyz", 127},
+	}
+	for _, test := range tests {
+		textView.Clear()
+		out := runLineAndWait(t, test.line+"; echo status $?")
+		if want := fmt.Sprintf("status %d", test.status); !strings.Contains(out, want) {
+			t.Errorf("%s: output %q, want %q", test.line, out, want)
+		}
+	}
+}
+
+// waitForForeground waits for the foreground job, if any.
+func waitForForeground(t *testing.T) {
+	t.Helper()
+	mu.Lock()
+	job := foregroundJob
+	mu.Unlock()
+	if job != nil {
+		waitForJob(t, job)
+	}
+}
+
+func TestPipelineOutputToWriter(t *testing.T) {
+	dir := setupTestUI(t)
+
+	// Anything written to the real standard output ends up in this file
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	realStdout := os.Stdout
+	os.Stdout = stdout
+	defer func() { os.Stdout = realStdout }()
+
+	var out bytes.Buffer
+	executePipedCommands("printf 'b\\na\\n' | sort", &out)
+	waitForForeground(t)
+	executePipedCommands("sh -c 'echo oops >&2' | cat", &out)
+	waitForForeground(t)
+	os.Stdout = realStdout
+
+	if got := out.String(); got != "a\nb\noops\n" {
+		t.Errorf("writer got %q, want the pipelines' output and errors", got)
+	}
+	if data, _ := os.ReadFile(stdout.Name()); len(data) > 0 {
+		t.Errorf("standard output got %q", data)
+	}
+}
+
+func TestPipelineStages(t *testing.T) {
+	dir := setupTestUI(t)
+	writeTestFile(t, dir, "words.txt", "pear\napple\nfig\napple\n")
+
+	out := runLineAndWait(t, "cat words.txt | sort | uniq -c")
+	if !strings.Contains(out, "2 apple") || !strings.Contains(out, "1 pear") {
+		t.Errorf("three-stage pipeline output = %q", out)
+	}
+
+	// A missing middle stage stops the pipeline before anything runs, so
+	// the last stage never creates its file
+	textView.Clear()
+	out = runLineAndWait(t, "cat words.txt | missing-command-xyz | tee copy.txt")
+	if !strings.Contains(out, "missing-command-xyz") || exitStatus() != 127 {
+		t.Errorf("missing middle stage: status %d, output %q", exitStatus(), out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "copy.txt")); err == nil {
+		t.Error("the last stage ran despite the missing middle stage")
+	}
+	mu.Lock()
+	job := foregroundJob
+	mu.Unlock()
+	if job != nil && !job.isDone() {
+		t.Error("the failed pipeline left a foreground job")
+	}
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	setupTestUI(t)
+	size := shellHistorySize
+	t.Cleanup(func() { shellHistorySize = size })
+
+	mu.Lock()
+	history = []string{"ls -la", "echo 'a  b'", "for i in 1 2\ndo echo $i\ndone", "cd /tmp"}
+	historyTimes = make([]time.Time, len(history))
+	mu.Unlock()
+	path := historyFilePath()
+	if filepath.Dir(path) != os.Getenv("HOME") {
+		t.Fatalf("history file %s is not in $HOME", path)
+	}
+	saveHistory(path)
+
+	mu.Lock()
+	history, historyTimes = nil, nil
+	mu.Unlock()
+	loadHistory(path)
+	mu.Lock()
+	loaded := slices.Clone(history)
+	times := len(historyTimes)
+	mu.Unlock()
+	// The entry spanning several lines is not saved
+	want := []string{"ls -la", "echo 'a  b'", "cd /tmp"}
+	if !slices.Equal(loaded, want) || times != len(want) {
+		t.Errorf("loaded %q with %d times, want %q", loaded, times, want)
+	}
+
+	// Only the last history-size entries are kept
+	shellHistorySize = 2
+	mu.Lock()
+	history, historyTimes = nil, nil
+	mu.Unlock()
+	loadHistory(path)
+	mu.Lock()
+	loaded = slices.Clone(history)
+	mu.Unlock()
+	if !slices.Equal(loaded, want[1:]) {
+		t.Errorf("loaded %q with history-size 2, want %q", loaded, want[1:])
+	}
+}
+
+func TestHistoryClearAndLimit(t *testing.T) {
+	setupTestUI(t)
+	mu.Lock()
+	for i := 1; i <= 8; i++ {
+		history = append(history, fmt.Sprintf("echo %d", i))
+		historyTimes = append(historyTimes, time.Now())
+	}
+	mu.Unlock()
+
+	var out bytes.Buffer
+	historyCommand([]string{"5"}, &out)
+	if want := "4 echo 4\n5 echo 5\n6 echo 6\n7 echo 7\n8 echo 8\n"; out.String() != want {
+		t.Errorf("history 5 = %q, want %q", out.String(), want)
+	}
+
+	saveHistory(historyFilePath())
+	historyCommand([]string{"-c"}, &out)
+	mu.Lock()
+	left, times := len(history), len(historyTimes)
+	mu.Unlock()
+	if left != 0 || times != 0 {
+		t.Errorf("history -c left %d entries and %d times", left, times)
+	}
+	if entries := readHistoryFile(historyFilePath()); len(entries) != 0 {
+		t.Errorf("history -c left %q in the history file", entries)
+	}
+}
+
+func TestReverseSearch(t *testing.T) {
+	setupTestUI(t)
+	mu.Lock()
+	history = []string{"git status", "ls", "git commit", "git status", "git push"}
+	mu.Unlock()
+	t.Cleanup(func() { reverseSearch = nil })
+
+	// Matches come newest first, each entry once
+	if got, want := searchHistory("git"), []string{"git push", "git status", "git commit"}; !slices.Equal(got, want) {
+		t.Errorf("searchHistory = %q, want %q", got, want)
+	}
+
+	press := func(key tcell.Key, r rune) {
+		handleReverseSearchKey(tcell.NewEventKey(key, r, tcell.ModNone))
+	}
+	setInput("typed")
+	reverseSearch = &historySearch{original: input}
+	for _, r := range "git" {
+		press(tcell.KeyRune, r)
+	}
+	var found []string
+	for i := 0; i < 4; i++ {
+		found = append(found, reverseSearch.match())
+		press(tcell.KeyCtrlR, 0)
+	}
+	// Ctrl-R steps back to older matches and stays on the oldest
+	if want := []string{"git push", "git status", "git commit", "git commit"}; !slices.Equal(found, want) {
+		t.Errorf("matches shown = %q, want %q", found, want)
+	}
+	press(tcell.KeyEnter, 0)
+	if reverseSearch != nil || input != "git commit" {
+		t.Errorf("after Enter: input %q, search %v", input, reverseSearch)
+	}
+
+	reverseSearch = &historySearch{original: "typed"}
+	press(tcell.KeyRune, 'l')
+	press(tcell.KeyEscape, 0)
+	if reverseSearch != nil || input != "typed" {
+		t.Errorf("after Escape: input %q, want the original line", input)
+	}
+}
+
+func TestForegroundCommandIsJob(t *testing.T) {
+	dir := setupTestUI(t)
+
+	// A single command runs as the foreground job, so the UI goroutine is
+	// free and Ctrl-C reaches it
+	for _, line := range []string{"sleep 10", "sleep 10 > out.txt"} {
+		runLine(line)
+		mu.Lock()
+		job := foregroundJob
+		mu.Unlock()
+		if job == nil || job.isDone() {
+			t.Fatalf("%s: no foreground job", line)
+		}
+		if !interruptForegroundJob() {
+			t.Fatalf("%s: Ctrl-C did not reach the job", line)
+		}
+		waitForJob(t, job)
+		runLineAndWait(t, "echo status $? > status.txt")
+		if data, _ := os.ReadFile(filepath.Join(dir, "status.txt")); string(data) != "status 130\n" {
+			t.Errorf("%s: after Ctrl-C %q, want status 130", line, data)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	setupTestUI(t)
+
+	start := time.Now()
+	out := runLineAndWait(t, "timeout 0.2 sleep 10; echo status $?")
+	if !strings.Contains(out, "status 124") {
+		t.Errorf("output = %q, want status 124", out)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timeout took %s to stop the command", elapsed)
+	}
+
+	textView.Clear()
+	out = runLineAndWait(t, "timeout 5 sh -c 'exit 3'; echo status $?")
+	if !strings.Contains(out, "status 3") {
+		t.Errorf("output = %q, want the command's own status", out)
+	}
+
+	// While it runs, the command is the foreground job
+	runLine("timeout 10 sleep 10")
+	mu.Lock()
+	job := foregroundJob
+	mu.Unlock()
+	if job == nil || !interruptForegroundJob() {
+		t.Fatal("timeout did not run its command as the foreground job")
+	}
+	waitForJob(t, job)
+	runPendingCommands()
+}
+
+func TestRunScript(t *testing.T) {
+	dir := setupTestUI(t)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a #! line, or with one naming dyshell, the lines run in the
+	// shell itself
+	writeTestFile(t, dir, "plain.dy", "cd sub\necho hello > out.txt\nsh -c 'exit 3'\n")
+	if status := runScript("plain.dy", nil); status != 3 {
+		t.Errorf("plain script: status %d, want 3", status)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "sub", "out.txt")); string(data) != "hello\n" {
+		t.Errorf("plain script: out.txt = %q, want the script run in the shell", data)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir, "self.dy", "#!/usr/bin/env dyshell\nmath 6 * 7 > self.txt\n")
+	if status := runScript("self.dy", nil); status != 0 {
+		t.Errorf("dyshell script: status %d, want 0", status)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "self.txt")); strings.TrimSpace(string(data)) != "42" {
+		t.Errorf("dyshell script: self.txt = %q, want the math builtin's output", data)
+	}
+
+	// Another interpreter gets the file and the arguments
+	writeTestFile(t, dir, "other.sh", "#!/bin/sh\necho \"$0 $1\" > sh.txt\nexit 4\n")
+	if status := runScript("other.sh", []string{"arg"}); status != 4 {
+		t.Errorf("sh script: status %d, want 4", status)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "sh.txt")); string(data) != "other.sh arg\n" {
+		t.Errorf("sh script: sh.txt = %q", data)
+	}
+}
+
+func TestSourceIgnoresShebang(t *testing.T) {
+	dir := setupTestUI(t)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir, "env.sh", "#!/bin/sh\ncd sub\n")
+
+	// Sourcing runs the file in the current shell, so its cd stays
+	runLineAndWait(t, "source env.sh")
+	if wd, _ := os.Getwd(); filepath.Base(wd) != "sub" {
+		t.Errorf("working directory %s after source, want sub", wd)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := setupTestUI(t)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, os.Getenv("HOME"), ".my_shellrc", "alias ll='ls -la'\ncd "+filepath.Join(dir, "sub")+"\n")
+
+	t.Cleanup(func() {
+		mu.Lock()
+		delete(aliases, "ll")
+		mu.Unlock()
+	})
+
+	output := runLineAndWait(t, "reload")
+	if !strings.Contains(output, "configuration reloaded") {
+		t.Errorf("reload printed %q", output)
+	}
+	mu.Lock()
+	alias := aliases["ll"]
+	mu.Unlock()
+	if alias != "ls -la" {
+		t.Errorf("alias ll = %q after reload, want %q", alias, "ls -la")
+	}
+	// The rc file runs in the current shell, so its cd stays
+	if wd, _ := os.Getwd(); filepath.Base(wd) != "sub" {
+		t.Errorf("working directory %s after reload, want sub", wd)
+	}
+}
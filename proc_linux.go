@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is the kernel's USER_HZ, which is 100 on every mainstream
+// Linux platform.
+const clockTicks = 100
+
+// processStat reads the scheduler state and consumed CPU time of pid from
+// /proc/<pid>/stat.
+func processStat(pid int) (state string, cpu time.Duration, ok bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", 0, false
+	}
+	// The command name is in parentheses and may itself contain spaces,
+	// so the remaining fields start after the last closing parenthesis.
+	end := strings.LastIndexByte(string(data), ')')
+	if end == -1 {
+		return "", 0, false
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 13 {
+		return "", 0, false
+	}
+	utime, err1 := strconv.ParseInt(fields[11], 10, 64)
+	stime, err2 := strconv.ParseInt(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return fields[0], 0, true
+	}
+	return fields[0], time.Duration(utime+stime) * time.Second / clockTicks, true
+}
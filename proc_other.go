@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "time"
+
+// processStat is only implemented where /proc is available.
+func processStat(pid int) (state string, cpu time.Duration, ok bool) {
+	return "", 0, false
+}
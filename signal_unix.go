@@ -3,10 +3,91 @@
 package main
 
 import (
+	"os"
 	"os/exec"
+	"os/signal"
 	"syscall"
 )
 
-func sendSignalContinue(job *exec.Cmd) error {
-	return job.Process.Signal(syscall.SIGCONT)
+// setProcessGroup makes cmd join the process group pgid, or start a new
+// group led by itself when pgid is 0. Keeping jobs out of the shell's own
+// group means signals aimed at a job never reach dyshell. The TUI keeps the
+// terminal for itself; jobs read no terminal input, so the foreground job
+// does not need to own the terminal's process group.
+func setProcessGroup(cmd *exec.Cmd, pgid int) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: pgid}
+}
+
+// processGroupOf returns the process group of a started command.
+func processGroupOf(cmd *exec.Cmd) int {
+	pgid, err := syscall.Getpgid(cmd.Process.Pid)
+	if err != nil {
+		return cmd.Process.Pid
+	}
+	return pgid
+}
+
+// signalOf returns the number of the signal that killed a process, if one
+// did.
+func signalOf(state *os.ProcessState) (int, bool) {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return 0, false
+	}
+	return int(status.Signal()), true
+}
+
+// signalJob delivers sig to the job's process group, or to each of its
+// processes when it has no group of its own.
+func signalJob(job *Job, sig syscall.Signal) error {
+	if job.Pgid > 0 {
+		return syscall.Kill(-job.Pgid, sig)
+	}
+	for _, cmd := range job.Cmds {
+		if err := cmd.Process.Signal(sig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendSignalContinue(job *Job) error {
+	return signalJob(job, syscall.SIGCONT)
+}
+
+func sendSignalInterrupt(job *Job) error {
+	job.cancelBuiltins()
+	return signalJob(job, syscall.SIGINT)
+}
+
+func sendSignalStop(job *Job) error {
+	if len(job.Cmds) == 0 {
+		return errBuiltinJobStop
+	}
+	return signalJob(job, syscall.SIGTSTP)
+}
+
+func sendSignalTerm(job *Job) error {
+	job.cancelBuiltins()
+	return signalJob(job, syscall.SIGTERM)
+}
+
+func sendSignalKill(job *Job) error {
+	job.cancelBuiltins()
+	return signalJob(job, syscall.SIGKILL)
+}
+
+// handleReloadSignal reloads the configuration files whenever dyshell gets
+// SIGHUP, so they can be edited from outside a running session.
+func handleReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			app.QueueUpdateDraw(func() {
+				reloadConfig(textView)
+				updatePrompt()
+			})
+		}
+	}()
 }
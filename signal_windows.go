@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op on Windows, which has no process groups.
+func setProcessGroup(cmd *exec.Cmd, pgid int) {}
+
+// processGroupOf always returns 0 on Windows, meaning the job is signalled
+// process by process.
+func processGroupOf(cmd *exec.Cmd) int {
+	return 0
+}
+
+// signalOf always reports false on Windows, where processes are not killed
+// by signals.
+func signalOf(state *os.ProcessState) (int, bool) {
+	return 0, false
+}
+
+// sendSignalContinue is a placeholder for the SIGCONT signal handling in Windows.
+func sendSignalContinue(job *Job) error {
+	return errors.New("SIGCONT not supported on Windows")
+}
+
+// sendSignalStop is a placeholder for the SIGTSTP signal handling in Windows.
+func sendSignalStop(job *Job) error {
+	return errors.New("SIGTSTP not supported on Windows")
+}
+
+// sendSignalInterrupt kills the job, as Windows cannot send Ctrl-C to the
+// job's processes alone.
+func sendSignalInterrupt(job *Job) error {
+	return sendSignalKill(job)
+}
+
+// sendSignalTerm kills the job, as Windows has no SIGTERM to ask politely.
+func sendSignalTerm(job *Job) error {
+	return sendSignalKill(job)
+}
+
+// sendSignalKill kills each process of the job in turn.
+func sendSignalKill(job *Job) error {
+	job.cancelBuiltins()
+	for _, cmd := range job.Cmds {
+		if err := cmd.Process.Kill(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleReloadSignal does nothing on Windows, which has no SIGHUP; use the
+// reload builtin instead.
+func handleReloadSignal() {}